@@ -0,0 +1,492 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// egtbGenerator computes a table by retrograde analysis. Mates are found first,
+// then level by level of the distance to mate: the predecessors of a lost position
+// are won, a predecessor of won positions is lost when all its moves are lost.
+// Captures and promotions lead to other tables, which must be known.
+type egtbGenerator struct {
+	tables  *endgameTables
+	table   *endgameTable
+	values  []byte
+	decided []bool
+	// counts are the numbers of moves of a position not known to lose.
+	counts []uint8
+	// lossDTM is the longest loss by captures and promotions.
+	lossDTM []uint8
+	// levels hold the positions decided at a distance to mate, they are
+	// index<<1, or index<<1|1 for a win by a capture or promotion
+	// that may be found faster in the table.
+	levels [][]uint32
+}
+
+type egtbPredecessor struct {
+	index int
+	// ep is set if the move is a double pawn push that can be captured en passant,
+	// epValue is then the value of the best en passant capture.
+	ep      bool
+	epValue byte
+}
+
+// EndgameTableNames returns the names of all tables with up to pieces pieces
+// in the order they are generated.
+func EndgameTableNames(pieces int) []string {
+	pieces = min(pieces, egtbMaxPieces)
+	var sets [][]int
+	var add func(set []int, first int)
+	add = func(set []int, first int) {
+		sets = append(sets, set)
+		if len(set) < pieces-2 {
+			for piece := first; piece <= Queen; piece++ {
+				add(append(append([]int(nil), set...), piece), piece)
+			}
+		}
+	}
+	add(nil, Pawn)
+	var found = make(map[string]bool)
+	var result []string
+	for _, white := range sets {
+		for _, black := range sets {
+			if len(white)+len(black) == 0 || 2+len(white)+len(black) > pieces {
+				continue
+			}
+			var name, _ = egtbMaterialName(white, black)
+			if !found[name] {
+				found[name] = true
+				result = append(result, name)
+			}
+		}
+	}
+	sortEgtbNames(result)
+	return result
+}
+
+// sortEgtbNames sorts names so that captures and promotions lead to earlier tables.
+func sortEgtbNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		var a, b = names[i], names[j]
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		var pawnsA, pawnsB = strings.Count(a, "P"), strings.Count(b, "P")
+		if pawnsA != pawnsB {
+			return pawnsA < pawnsB
+		}
+		return a < b
+	})
+}
+
+// egtbDependencies returns the tables reached by captures and promotions.
+func egtbDependencies(name string) []string {
+	var white, black, _ = parseEgtbMaterial(name)
+	var result []string
+	var add = func(white, black []int) {
+		if len(white)+len(black) > 0 {
+			var dependency, _ = egtbMaterialName(white, black)
+			result = append(result, dependency)
+		}
+	}
+	var without = func(pieces []int, i int) []int {
+		return append(append([]int(nil), pieces[:i]...), pieces[i+1:]...)
+	}
+	var promoted = func(pieces []int, i, piece int) []int {
+		var result = append([]int(nil), pieces...)
+		result[i] = piece
+		return result
+	}
+	for i, piece := range white {
+		add(without(white, i), black)
+		if piece == Pawn {
+			for promotion := Knight; promotion <= Queen; promotion++ {
+				add(promoted(white, i, promotion), black)
+			}
+		}
+	}
+	for i, piece := range black {
+		add(white, without(black, i))
+		if piece == Pawn {
+			for promotion := Knight; promotion <= Queen; promotion++ {
+				add(white, promoted(black, i, promotion))
+			}
+		}
+	}
+	return result
+}
+
+// BuildEndgameTables generates the tables of names and the tables they depend on
+// into dir. Tables already in dir are read instead of generated.
+// A line per table is written to progress.
+func BuildEndgameTables(dir string, names []string, progress io.Writer) error {
+	var needed = make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if needed[name] {
+			return nil
+		}
+		if _, err := newEndgameTable(name); err != nil {
+			return err
+		}
+		needed[name] = true
+		for _, dependency := range egtbDependencies(name) {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		var white, black, ok = parseEgtbMaterial(name)
+		if !ok {
+			return fmt.Errorf("wrong endgame table name %v", name)
+		}
+		name, _ = egtbMaterialName(white, black)
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	var order []string
+	for name := range needed {
+		order = append(order, name)
+	}
+	sortEgtbNames(order)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var tables = newEndgameTables()
+	for _, name := range order {
+		var t, _ = newEndgameTable(name)
+		t.path = filepath.Join(dir, name+egtbSuffix)
+		if _, err := os.Stat(t.path); err == nil {
+			if !t.load() {
+				return fmt.Errorf("%v: %w", t.path, t.err)
+			}
+			fmt.Fprintf(progress, "%v found\n", name)
+			tables.add(t)
+			continue
+		}
+		var start = time.Now()
+		if err := generateEndgameTable(tables, t); err != nil {
+			return err
+		}
+		if err := t.write(t.path); err != nil {
+			return err
+		}
+		t.load()
+		tables.add(t)
+		var stats = t.stats()
+		fmt.Fprintf(progress, "%v generated: %v wins, %v draws, %v losses, longest mate %v plies, %v\n",
+			name, stats.wins, stats.draws, stats.losses, stats.longestMate,
+			time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// generateEndgameTable computes the values of t, the tables of captures and promotions
+// must be in tables.
+func generateEndgameTable(tables *endgameTables, t *endgameTable) error {
+	var g = &egtbGenerator{
+		tables:  tables,
+		table:   t,
+		values:  make([]byte, t.size),
+		decided: make([]bool, t.size),
+		counts:  make([]uint8, t.size),
+		lossDTM: make([]uint8, t.size),
+	}
+	if err := g.init(); err != nil {
+		return err
+	}
+	for level := 0; level < len(g.levels); level++ {
+		for _, entry := range g.levels[level] {
+			var idx = int(entry >> 1)
+			if entry&1 != 0 {
+				if g.decided[idx] {
+					continue
+				}
+				g.decided[idx] = true
+				g.values[idx] = egtbWin(level)
+			}
+			if err := g.propagate(idx, level); err != nil {
+				return err
+			}
+		}
+		g.levels[level] = nil
+	}
+	t.values = g.values
+	return nil
+}
+
+// init finds the mates and the values of captures and promotions.
+func (g *egtbGenerator) init() error {
+	var t = g.table
+	var buffer [MAX_MOVES]Move
+	var child Position
+	var children []int
+	for idx := 0; idx < t.size; idx++ {
+		var p = t.position(idx)
+		if p == nil {
+			g.decided[idx] = true
+			continue
+		}
+		children = children[:0]
+		var legalMoves, others = 0, 0
+		var winDTM, lossDTM = egtbMaxDTM + 2, 0
+		for _, move := range GenerateMoves(p, buffer[:]) {
+			if !p.MakeMove(move, &child) {
+				continue
+			}
+			legalMoves++
+			if move.CapturedPiece() != Empty || move.Promotion() != Empty {
+				var v, ok = g.tables.probe(&child)
+				if !ok {
+					return fmt.Errorf("%v: no table for %v", t.name, &child)
+				}
+				var result, dtm = egtbResult(egtbParent(v))
+				switch result {
+				case 1:
+					winDTM = min(winDTM, dtm)
+					others++
+				case -1:
+					lossDTM = max(lossDTM, dtm)
+				default:
+					others++
+				}
+				continue
+			}
+			if child.EpSquare != SquareNone {
+				var ep, found, err = g.epCaptureValue(&child)
+				if err != nil {
+					return err
+				}
+				// The distance to mate may be shorter without the en passant capture.
+				if result, dtm := egtbResult(ep); found && result == 1 {
+					lossDTM = max(lossDTM, dtm+1)
+					continue
+				}
+			}
+			var childIndex = t.positionIndex(&child, false)
+			if !containsInt(children, childIndex) {
+				children = append(children, childIndex)
+			}
+		}
+		g.counts[idx] = uint8(len(children) + others)
+		g.lossDTM[idx] = uint8(lossDTM)
+		var err error
+		switch {
+		case legalMoves == 0:
+			g.decided[idx] = true
+			if p.IsCheck() {
+				err = g.decide(idx, 0, false)
+			}
+		case g.counts[idx] == 0:
+			err = g.decide(idx, lossDTM, false)
+		case winDTM <= egtbMaxDTM:
+			g.push(winDTM, idx<<1|1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsInt(items []int, x int) bool {
+	for _, item := range items {
+		if item == x {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *egtbGenerator) push(level, entry int) {
+	for len(g.levels) <= level {
+		g.levels = append(g.levels, nil)
+	}
+	g.levels[level] = append(g.levels[level], uint32(entry))
+}
+
+// decide sets the value of a position that is not found at another distance to mate.
+func (g *egtbGenerator) decide(idx, dtm int, win bool) error {
+	if dtm > egtbMaxDTM+1 {
+		return fmt.Errorf("%v: distance to mate over %v plies", g.table.name, egtbMaxDTM)
+	}
+	g.decided[idx] = true
+	if win {
+		g.values[idx] = egtbWin(dtm)
+	} else {
+		g.values[idx] = egtbLoss(dtm)
+	}
+	g.push(dtm, idx<<1)
+	return nil
+}
+
+// propagate updates the predecessors of a position decided at level.
+func (g *egtbGenerator) propagate(idx, level int) error {
+	var win = g.values[idx] < 128
+	var predecessors, err = g.predecessors(g.table.position(idx))
+	if err != nil {
+		return err
+	}
+	for _, pred := range predecessors {
+		var q = pred.index
+		if g.decided[q] {
+			continue
+		}
+		var epResult, epDTM = egtbResult(pred.epValue)
+		if win {
+			// A push that loses to the capture was counted as lost in init.
+			if pred.ep && epResult == 1 {
+				continue
+			}
+			g.counts[q]--
+			if g.counts[q] == 0 {
+				err = g.decide(q, max(level+1, int(g.lossDTM[q])), false)
+			}
+		} else if !pred.ep {
+			err = g.decide(q, level+1, true)
+		} else if epResult == -1 {
+			// The opponent chooses the longer loss.
+			if epDTM > level {
+				g.push(epDTM+1, q<<1|1)
+			} else {
+				err = g.decide(q, level+1, true)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// predecessors returns the positions with a move to p that is not a capture
+// or a promotion, each position once.
+func (g *egtbGenerator) predecessors(p *Position) ([]egtbPredecessor, error) {
+	var t = g.table
+	var result []egtbPredecessor
+	var mover = !p.WhiteMove
+	var occ = p.White | p.Black
+	for b := p.piecesByColor(mover); b != 0; b &= b - 1 {
+		var to = FirstOne(b)
+		var piece = p.WhatPiece(to)
+		var fromBB uint64
+		var doublePush = SquareNone
+		switch piece {
+		case Pawn:
+			var back, from = 8, to - 8
+			if !mover {
+				back, from = -8, to+8
+			}
+			if Rank(from) != Rank1 && Rank(from) != Rank8 && occ&squareMask[from] == 0 {
+				fromBB = squareMask[from]
+				if (mover && Rank(to) == Rank4 || !mover && Rank(to) == Rank5) &&
+					occ&squareMask[from-back] == 0 {
+					doublePush = from - back
+				}
+			}
+		case Knight:
+			fromBB = knightAttacks[to] &^ occ
+		case Bishop:
+			fromBB = BishopAttacks(to, occ) &^ occ
+		case Rook:
+			fromBB = RookAttacks(to, occ) &^ occ
+		case Queen:
+			fromBB = QueenAttacks(to, occ) &^ occ
+		case King:
+			fromBB = kingAttacks[to] &^ occ
+		}
+		if doublePush != SquareNone {
+			fromBB |= squareMask[doublePush]
+		}
+		for ; fromBB != 0; fromBB &= fromBB - 1 {
+			var from = FirstOne(fromBB)
+			var q = *p
+			movePiece(&q, piece, mover, to, from)
+			q.WhiteMove = mover
+			if !q.isLegal() {
+				continue
+			}
+			var pred = egtbPredecessor{index: t.positionIndex(&q, false)}
+			if from == doublePush {
+				var c = *p
+				c.EpSquare = (from + to) / 2
+				var found bool
+				var err error
+				pred.epValue, found, err = g.epCaptureValue(&c)
+				if err != nil {
+					return nil, err
+				}
+				pred.ep = found
+			}
+			if !containsPredecessor(result, pred.index) {
+				result = append(result, pred)
+			}
+		}
+	}
+	return result, nil
+}
+
+func containsPredecessor(items []egtbPredecessor, idx int) bool {
+	for _, item := range items {
+		if item.index == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// epCaptureValue returns the value of the best en passant capture in p,
+// found is false if there is no legal en passant capture.
+func (g *egtbGenerator) epCaptureValue(p *Position) (v byte, found bool, err error) {
+	var child Position
+	var bestRank = 0
+	var ownPawns = p.Pawns & p.piecesByColor(p.WhiteMove)
+	for fromBB := PawnAttacks(p.EpSquare, !p.WhiteMove) & ownPawns; fromBB != 0; fromBB &= fromBB - 1 {
+		var move = MakeMove(FirstOne(fromBB), p.EpSquare, Pawn, Pawn)
+		if !p.MakeMove(move, &child) {
+			continue
+		}
+		var childValue, ok = g.tables.probe(&child)
+		if !ok {
+			return 0, false, fmt.Errorf("%v: no table for %v", g.table.name, &child)
+		}
+		var value = egtbParent(childValue)
+		if !found || egtbRank(value) > bestRank {
+			v, bestRank, found = value, egtbRank(value), true
+		}
+	}
+	return v, found, nil
+}
+
+type egtbStats struct {
+	wins, draws, losses, longestMate int
+}
+
+// stats counts the results of the legal positions of a generated table.
+func (t *endgameTable) stats() egtbStats {
+	var result egtbStats
+	for idx, v := range t.values {
+		var res, dtm = egtbResult(v)
+		switch {
+		case res == 1:
+			result.wins++
+			result.longestMate = max(result.longestMate, dtm)
+		case res == -1:
+			result.losses++
+			result.longestMate = max(result.longestMate, dtm)
+		case t.position(idx) != nil:
+			result.draws++
+		}
+	}
+	return result
+}
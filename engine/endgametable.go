@@ -0,0 +1,599 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Built-in endgame tables store for every position of an endgame with up to
+// four pieces the distance to mate in plies. Tables are named by the pieces
+// of the stronger side and of the weaker side, like KQKR, and cover the
+// positions with either side stronger by swapping colours.
+//
+// Table file layout, all numbers little endian:
+//
+//	magic    [8]byte "CNTREGTB"
+//	version  uint32
+//	material [8]byte name of the table, padded with zeros
+//	size     uint64  number of positions
+//	size * value byte
+//
+// A value is 0 for a draw or an illegal position, 1..127 for a win in 2*v-1 plies
+// and 128..255 for a loss in 2*(v-128) plies, 128 is checkmate.
+// The tables know nothing about the 50 move rule and en passant captures
+// of the probed position, positions with castle rights are not in the tables.
+const (
+	egtbFileMagic   = "CNTREGTB"
+	egtbFileVersion = 1
+	egtbSuffix      = ".egtb"
+	egtbMaxPieces   = 4
+	egtbMaxDTM      = 253
+)
+
+// egtbKnownWin is the evaluation of a won table position, below mate scores.
+const egtbKnownWin = VALUE_MATE_IN_MAX_HEIGHT / 2
+
+var errWrongEndgameTable = errors.New("not an endgame table file")
+
+// egtbKingSquares are the squares of the triangle a1-d1-d4, the squares of the
+// white king in tables without pawns. Every position has a symmetric position
+// with the white king on one of them.
+var egtbKingSquares = []int{
+	0, 1, 2, 3,
+	9, 10, 11,
+	18, 19,
+	27,
+}
+
+// egtbKingCode maps the square of the white king to its index in tables without pawns
+// and in tables with pawns, -1 if the square is not used.
+var egtbKingCode [2][64]int
+
+type egtbPiece struct {
+	piece int
+	white bool
+}
+
+type endgameTable struct {
+	name string
+	// pieces in the order of the index: white king, black king, other pieces
+	pieces   []egtbPiece
+	hasPawns bool
+	size     int
+	path     string
+	once     sync.Once
+	values   []byte
+	err      error
+}
+
+// endgameTables are the tables of a directory, a table is read on its first probe.
+type endgameTables struct {
+	tables map[string]*endgameTable
+	// byMaterial finds the table of a position by egtbMaterialKey of white.
+	byMaterial map[int]egtbEntry
+	maxPieces  int
+}
+
+// egtbEntry is a table, with flip the colours of the position are swapped.
+type egtbEntry struct {
+	table *endgameTable
+	flip  bool
+}
+
+var egtbPieceChars = "PNBRQK"
+
+// egtbPieceWeights decide which side is stronger.
+var egtbPieceWeights = [...]int{Pawn: 1, Knight: 3, Bishop: 3, Rook: 5, Queen: 9}
+
+// egtbSideName returns the pieces of one side, strongest first, like KRP.
+func egtbSideName(pieces []int) string {
+	var sorted = append([]int(nil), pieces...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	var result = "K"
+	for _, piece := range sorted {
+		result += string(egtbPieceChars[piece-Pawn])
+	}
+	return result
+}
+
+func egtbSideWeight(pieces []int) int {
+	var result = 0
+	for _, piece := range pieces {
+		result += egtbPieceWeights[piece]
+	}
+	return result
+}
+
+// egtbMaterialName returns the name of the table of the pieces without kings.
+// flip is true if black is the stronger side of the table.
+func egtbMaterialName(white, black []int) (name string, flip bool) {
+	var whiteName, blackName = egtbSideName(white), egtbSideName(black)
+	var whiteWeight, blackWeight = egtbSideWeight(white), egtbSideWeight(black)
+	if whiteWeight < blackWeight ||
+		whiteWeight == blackWeight && whiteName < blackName {
+		return blackName + whiteName, true
+	}
+	return whiteName + blackName, false
+}
+
+// parseEgtbMaterial splits a table name like KRPKR into the pieces of both sides.
+func parseEgtbMaterial(name string) (white, black []int, ok bool) {
+	var k = strings.LastIndexByte(name, 'K')
+	if len(name) < 2 || name[0] != 'K' || k <= 0 {
+		return nil, nil, false
+	}
+	var parse = func(s string) ([]int, bool) {
+		var result []int
+		for i := 0; i < len(s); i++ {
+			var piece = strings.IndexByte(egtbPieceChars[:5], s[i])
+			if piece < 0 {
+				return nil, false
+			}
+			result = append(result, piece+Pawn)
+		}
+		return result, true
+	}
+	var okWhite, okBlack bool
+	white, okWhite = parse(name[1:k])
+	black, okBlack = parse(name[k+1:])
+	if !okWhite || !okBlack || 2+len(white)+len(black) > egtbMaxPieces {
+		return nil, nil, false
+	}
+	return white, black, true
+}
+
+// newEndgameTable returns the table of a canonical name.
+func newEndgameTable(name string) (*endgameTable, error) {
+	var white, black, ok = parseEgtbMaterial(name)
+	if ok {
+		var canonical, flip = egtbMaterialName(white, black)
+		ok = canonical == name && !flip
+	}
+	if !ok || len(white)+len(black) == 0 {
+		return nil, fmt.Errorf("wrong endgame table name %v", name)
+	}
+	var t = &endgameTable{name: name}
+	t.pieces = []egtbPiece{{King, true}, {King, false}}
+	for _, piece := range []byte(egtbSideName(white)[1:]) {
+		t.pieces = append(t.pieces, egtbPiece{Pawn + strings.IndexByte(egtbPieceChars, piece), true})
+	}
+	for _, piece := range []byte(egtbSideName(black)[1:]) {
+		t.pieces = append(t.pieces, egtbPiece{Pawn + strings.IndexByte(egtbPieceChars, piece), false})
+	}
+	var kingCodes = len(egtbKingSquares)
+	for _, piece := range t.pieces {
+		if piece.piece == Pawn {
+			t.hasPawns = true
+			kingCodes = 32
+		}
+	}
+	t.size = 2 * kingCodes
+	for range t.pieces[1:] {
+		t.size *= 64
+	}
+	return t, nil
+}
+
+// egtbTransform maps a square by a symmetry of the board:
+// bit 0 mirrors files, bit 1 mirrors ranks, bit 2 swaps files and ranks.
+func egtbTransform(sq, transform int) int {
+	if transform&4 != 0 {
+		sq = (sq&7)<<3 | sq>>3
+	}
+	if transform&1 != 0 {
+		sq ^= 7
+	}
+	if transform&2 != 0 {
+		sq ^= 56
+	}
+	return sq
+}
+
+// index returns the index of the position with the squares of t.pieces.
+// Symmetric positions have the same index.
+func (t *endgameTable) index(squares *[egtbMaxPieces]int, whiteMove bool) int {
+	var transforms, codes = 8, &egtbKingCode[0]
+	if t.hasPawns {
+		transforms, codes = 2, &egtbKingCode[1]
+	}
+	var n = len(t.pieces)
+	var best = -1
+	for transform := 0; transform < transforms; transform++ {
+		var code = codes[egtbTransform(squares[0], transform)]
+		if code < 0 {
+			continue
+		}
+		var sq [egtbMaxPieces]int
+		for i := 1; i < n; i++ {
+			sq[i] = egtbTransform(squares[i], transform)
+			// equal pieces are sorted by square
+			for j := i; j > 2 && t.pieces[j] == t.pieces[j-1] && sq[j] < sq[j-1]; j-- {
+				sq[j], sq[j-1] = sq[j-1], sq[j]
+			}
+		}
+		var idx = code
+		for i := 1; i < n; i++ {
+			idx = idx*64 + sq[i]
+		}
+		if best == -1 || idx < best {
+			best = idx
+		}
+	}
+	if whiteMove {
+		return 2 * best
+	}
+	return 2*best + 1
+}
+
+// squares returns the squares and the side to move of an index.
+func (t *endgameTable) squares(idx int) (squares [egtbMaxPieces]int, whiteMove bool) {
+	whiteMove = idx&1 == 0
+	idx >>= 1
+	for i := len(t.pieces) - 1; i > 0; i-- {
+		squares[i] = idx % 64
+		idx /= 64
+	}
+	if t.hasPawns {
+		squares[0] = idx/4*8 + idx%4
+	} else {
+		squares[0] = egtbKingSquares[idx]
+	}
+	return
+}
+
+// position returns the legal position of an index, or nil.
+// Of symmetric positions only the one that index returns for them is used.
+func (t *endgameTable) position(idx int) *Position {
+	var squares, whiteMove = t.squares(idx)
+	var p = &Position{WhiteMove: whiteMove, EpSquare: SquareNone}
+	for i, piece := range t.pieces {
+		var sq = squares[i]
+		if (p.White|p.Black)&squareMask[sq] != 0 ||
+			piece.piece == Pawn && (Rank(sq) == Rank1 || Rank(sq) == Rank8) {
+			return nil
+		}
+		xorPiece(p, piece.piece, piece.white, sq)
+	}
+	if !p.isLegal() || t.index(&squares, whiteMove) != idx {
+		return nil
+	}
+	p.Checkers = p.computeCheckers()
+	return p
+}
+
+// positionIndex returns the index of p, with flip colours are swapped
+// and the board is mirrored vertically.
+func (t *endgameTable) positionIndex(p *Position, flip bool) int {
+	var squares [egtbMaxPieces]int
+	var used uint64
+	for i, piece := range t.pieces {
+		var b = pieceBitboard(p, piece.piece) & p.piecesByColor(piece.white != flip) &^ used
+		var sq = FirstOne(b)
+		used |= squareMask[sq]
+		if flip {
+			sq ^= 56
+		}
+		squares[i] = sq
+	}
+	return t.index(&squares, p.WhiteMove != flip)
+}
+
+func pieceBitboard(p *Position, piece int) uint64 {
+	switch piece {
+	case Pawn:
+		return p.Pawns
+	case Knight:
+		return p.Knights
+	case Bishop:
+		return p.Bishops
+	case Rook:
+		return p.Rooks
+	case Queen:
+		return p.Queens
+	case King:
+		return p.Kings
+	}
+	return 0
+}
+
+// egtbMaterialKey packs the numbers of pieces of the side white and of its opponent.
+func egtbMaterialKey(p *Position, white bool) int {
+	var result = 0
+	var own, opp = p.piecesByColor(white), p.piecesByColor(!white)
+	for piece := Pawn; piece <= Queen; piece++ {
+		var b = pieceBitboard(p, piece)
+		result += PopCount(b&own)<<(2*piece) + PopCount(b&opp)<<(2*piece+12)
+	}
+	return result
+}
+
+func egtbWin(dtm int) byte {
+	return byte((dtm + 1) / 2)
+}
+
+func egtbLoss(dtm int) byte {
+	return byte(128 + dtm/2)
+}
+
+// egtbResult decodes a value into the result for the side to move, from -1 to 1,
+// and the distance to mate in plies.
+func egtbResult(v byte) (result, dtm int) {
+	switch {
+	case v == 0:
+		return 0, 0
+	case v < 128:
+		return 1, 2*int(v) - 1
+	}
+	return -1, 2 * int(v-128)
+}
+
+// egtbRank orders values for the side to move: faster wins and slower losses first.
+func egtbRank(v byte) int {
+	var result, dtm = egtbResult(v)
+	switch result {
+	case 1:
+		return 1000 - dtm
+	case -1:
+		return -1000 + dtm
+	}
+	return 0
+}
+
+// egtbParent returns the value of a move for the side that made it,
+// given the value of the position after the move.
+func egtbParent(v byte) byte {
+	var result, dtm = egtbResult(v)
+	switch result {
+	case 1:
+		return egtbLoss(dtm + 1)
+	case -1:
+		return egtbWin(dtm + 1)
+	}
+	return 0
+}
+
+// openEndgameTables finds the tables in dir, the tables are read when they are probed.
+func openEndgameTables(dir string) (*endgameTables, error) {
+	var entries, err = os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result = newEndgameTables()
+	for _, entry := range entries {
+		var name, ok = strings.CutSuffix(entry.Name(), egtbSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		var t, err = newEndgameTable(name)
+		if err != nil {
+			continue
+		}
+		t.path = filepath.Join(dir, entry.Name())
+		result.add(t)
+	}
+	return result, nil
+}
+
+func newEndgameTables() *endgameTables {
+	return &endgameTables{
+		tables:     make(map[string]*endgameTable),
+		byMaterial: make(map[int]egtbEntry),
+	}
+}
+
+func (tables *endgameTables) add(t *endgameTable) {
+	tables.tables[t.name] = t
+	var key, flippedKey = 0, 0
+	for _, piece := range t.pieces {
+		if piece.piece == King {
+			continue
+		}
+		if piece.white {
+			key += 1 << (2 * piece.piece)
+			flippedKey += 1 << (2*piece.piece + 12)
+		} else {
+			key += 1 << (2*piece.piece + 12)
+			flippedKey += 1 << (2 * piece.piece)
+		}
+	}
+	tables.byMaterial[flippedKey] = egtbEntry{t, true}
+	tables.byMaterial[key] = egtbEntry{t, false}
+	tables.maxPieces = max(tables.maxPieces, len(t.pieces))
+}
+
+// probe returns the value of p for the side to move.
+// ok is false if the position is not in the tables.
+func (tables *endgameTables) probe(p *Position) (v byte, ok bool) {
+	var allPieces = p.White | p.Black
+	if allPieces == p.Kings {
+		return 0, true
+	}
+	if p.CastleRights != 0 || PopCount(allPieces) > tables.maxPieces {
+		return 0, false
+	}
+	// Tables do not store en passant rights.
+	if p.EpSquare != SquareNone &&
+		PawnAttacks(p.EpSquare, !p.WhiteMove)&p.Pawns&p.piecesByColor(p.WhiteMove) != 0 {
+		return 0, false
+	}
+	var entry, found = tables.byMaterial[egtbMaterialKey(p, true)]
+	if !found || !entry.table.load() {
+		return 0, false
+	}
+	return entry.table.values[entry.table.positionIndex(p, entry.flip)], true
+}
+
+// load reads the table on the first call and reports whether the table is usable.
+func (t *endgameTable) load() bool {
+	t.once.Do(func() {
+		if t.values == nil {
+			t.err = t.read()
+		}
+	})
+	return t.err == nil
+}
+
+type egtbFileHeader struct {
+	Magic    [8]byte
+	Version  uint32
+	Material [8]byte
+	Size     uint64
+}
+
+func (t *endgameTable) header() egtbFileHeader {
+	var result = egtbFileHeader{
+		Version: egtbFileVersion,
+		Size:    uint64(t.size),
+	}
+	copy(result.Magic[:], egtbFileMagic)
+	copy(result.Material[:], t.name)
+	return result
+}
+
+func (t *endgameTable) read() error {
+	var file, err = os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r = bufio.NewReader(file)
+	var header egtbFileHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header != t.header() {
+		return errWrongEndgameTable
+	}
+	var values = make([]byte, t.size)
+	if _, err := io.ReadFull(r, values); err != nil {
+		return err
+	}
+	t.values = values
+	return nil
+}
+
+func (t *endgameTable) write(path string) error {
+	var file, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+	var w = bufio.NewWriter(file)
+	err = binary.Write(w, binary.LittleEndian, t.header())
+	if err == nil {
+		_, err = w.Write(t.values)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (e *Engine) loadEndgameTables() {
+	// The transposition table keeps evaluations of the old tables.
+	e.clearTransTable()
+	e.endgameTables, e.endgameTablesErr = nil, nil
+	e.endgameTablesPath = e.EgtbPath.Value
+	if e.EgtbPath.Value == "" {
+		return
+	}
+	var tables, err = openEndgameTables(e.EgtbPath.Value)
+	if err != nil {
+		e.endgameTablesErr = err
+		return
+	}
+	if len(tables.tables) > 0 {
+		e.endgameTables = tables
+	}
+}
+
+// EndgameTablesInfo describes the built-in tables found in the EgtbPath directory.
+func (e *Engine) EndgameTablesInfo() string {
+	if e.endgameTablesErr != nil {
+		return fmt.Sprintf("Endgame tables not loaded: %v", e.endgameTablesErr)
+	}
+	if e.EgtbPath.Value == "" {
+		return "Endgame tables off"
+	}
+	if e.endgameTables == nil {
+		return "Endgame tables not found"
+	}
+	return fmt.Sprintf("Found %v endgame tables, up to %v pieces",
+		len(e.endgameTables.tables), e.endgameTables.maxPieces)
+}
+
+// probeEndgameTables returns the exact score of a position in the built-in tables.
+// Mates that do not fit in the search height get a known win score below the mate range.
+// The 50 move rule is not applied: captures and pawn moves on the mate line reset the counter.
+func (ctx *searchContext) probeEndgameTables() (score int, ok bool) {
+	var engine = ctx.Engine
+	if engine.endgameTables == nil || ctx.Height == 0 {
+		return
+	}
+	var v byte
+	if v, ok = engine.endgameTables.probe(ctx.Position); !ok {
+		return
+	}
+	engine.timeManager.IncTBHits()
+	var result, dtm = egtbResult(v)
+	switch result {
+	case 1:
+		if ctx.Height+dtm < MAX_HEIGHT {
+			return MateIn(ctx.Height + dtm), true
+		}
+		return egtbKnownWin - dtm, true
+	case -1:
+		if ctx.Height+dtm < MAX_HEIGHT {
+			return MatedIn(ctx.Height + dtm), true
+		}
+		return -egtbKnownWin + dtm, true
+	}
+	return ctx.DrawValue(), true
+}
+
+// egtbEvaluator evaluates table positions by their result, faster wins are better.
+type egtbEvaluator struct {
+	Evaluator
+	tables *endgameTables
+}
+
+func (e *egtbEvaluator) Evaluate(p *Position) int {
+	var v, ok = e.tables.probe(p)
+	if !ok {
+		return e.Evaluator.Evaluate(p)
+	}
+	var result, dtm = egtbResult(v)
+	switch result {
+	case 1:
+		return egtbKnownWin - dtm
+	case -1:
+		return -egtbKnownWin + dtm
+	}
+	return VALUE_DRAW
+}
+
+func init() {
+	for i := range egtbKingCode {
+		for sq := range egtbKingCode[i] {
+			egtbKingCode[i][sq] = -1
+		}
+	}
+	for code, sq := range egtbKingSquares {
+		egtbKingCode[0][sq] = code
+	}
+	for sq := 0; sq < 64; sq++ {
+		if File(sq) < FileE {
+			egtbKingCode[1][sq] = Rank(sq)*4 + File(sq)
+		}
+	}
+}
@@ -1,30 +1,13 @@
 package engine
 
 import (
+	"math/rand"
 	"runtime"
-)
-
-type UciOption interface {
-	Name() string
-}
-
-type BoolUciOption struct {
-	name  string
-	Value bool
-}
-
-func (o *BoolUciOption) Name() string {
-	return o.name
-}
-
-type IntUciOption struct {
-	name            string
-	Value, Min, Max int
-}
+	"sync"
+	"time"
 
-func (o *IntUciOption) Name() string {
-	return o.name
-}
+	"github.com/ChizhovVadim/CounterGo/syzygy"
+)
 
 type Evaluator interface {
 	Evaluate(p *Position) int
@@ -34,24 +17,79 @@ type Evaluator interface {
 type Engine struct {
 	Hash               IntUciOption
 	Threads            IntUciOption
+	MultiPV            IntUciOption
+	Ponder             BoolUciOption
+	SingularDepth      IntUciOption
+	SingularMargin     IntUciOption
+	MultiCut           BoolUciOption
+	Statistics         BoolUciOption
+	LimitStrength      BoolUciOption
+	Elo                IntUciOption // nominal, not a measured rating, see EloToSkillLevel
+	SkillLevel         IntUciOption
+	Contempt           IntUciOption
+	AnalyseMode        BoolUciOption
+	ClearHash          ButtonUciOption
+	HashFile           StringUciOption
+	SyzygyPath         StringUciOption
+	SyzygyProbeDepth   IntUciOption
+	EgtbPath           StringUciOption
+	OwnBook            BoolUciOption
+	BookFile           StringUciOption
+	BookVariety        IntUciOption
+	TimeControl        ComboUciOption
 	ExperimentSettings BoolUciOption
 	ClearTransTable    bool
+	RandomSeed         int64
 	historyTable       historyTable
 	transTable         *transTable
+	tablebases         *syzygy.Tablebases
+	tablebasesPath     string
+	tablebasesErr      error
+	endgameTables      *endgameTables
+	endgameTablesPath  string
+	endgameTablesErr   error
+	book               *Book
+	bookPath           string
+	bookErr            error
+	staticEvaluator    Evaluator
 	evaluator          Evaluator
+	random             *rand.Rand
+	contempt           int
 	historyKeys        []uint64
 	timeManager        *timeManager
 	tree               [][]searchContext
+	nodeCounters       []nodeCounter
 }
 
 func NewEngine() *Engine {
 	var numCPUs = runtime.NumCPU()
-	return &Engine{
-		Hash:               IntUciOption{"Hash", 4, 4, 512},
-		Threads:            IntUciOption{"Threads", numCPUs, 1, numCPUs},
-		ExperimentSettings: BoolUciOption{"ExperimentSettings", false},
-		historyTable:       NewHistoryTable(),
+	var e = &Engine{
+		MultiPV:          IntUciOption{"MultiPV", 1, 1, MAX_MOVES, nil},
+		Ponder:           BoolUciOption{"Ponder", false, nil},
+		SingularDepth:    IntUciOption{"SingularDepth", 8, 0, MAX_HEIGHT, nil},
+		SingularMargin:   IntUciOption{"SingularMargin", 2, 0, PawnValue, nil},
+		MultiCut:         BoolUciOption{"MultiCut", true, nil},
+		Statistics:       BoolUciOption{"Statistics", false, nil},
+		LimitStrength:    BoolUciOption{"UCI_LimitStrength", false, nil},
+		Elo:              IntUciOption{"UCI_Elo", MaxElo, MinElo, MaxElo, nil},
+		SkillLevel:       IntUciOption{"Skill Level", MaxSkillLevel, 0, MaxSkillLevel, nil},
+		Contempt:         IntUciOption{"Contempt", 0, -PawnValue, PawnValue, nil},
+		AnalyseMode:      BoolUciOption{"UCI_AnalyseMode", false, nil},
+		HashFile:         StringUciOption{"Hash File", "counter.hash", nil},
+		SyzygyProbeDepth: IntUciOption{"SyzygyProbeDepth", 1, 1, 100, nil},
+		OwnBook:          BoolUciOption{"OwnBook", false, nil},
+		BookVariety:      IntUciOption{"Book Variety", 50, 0, 100, nil},
+		TimeControl:      ComboUciOption{"TimeControl", "Basic", []string{"Basic", "Cautious"}, nil},
+		historyTable:     NewHistoryTable(),
 	}
+	e.Hash = IntUciOption{"Hash", 4, 4, MaxHash, e.resizeTransTable}
+	e.Threads = IntUciOption{"Threads", numCPUs, 1, numCPUs, e.resizeTree}
+	e.ClearHash = ButtonUciOption{"Clear Hash", e.clearTransTable}
+	e.ExperimentSettings = BoolUciOption{"ExperimentSettings", false, e.resetEvaluation}
+	e.SyzygyPath = StringUciOption{"SyzygyPath", "", e.loadTablebases}
+	e.EgtbPath = StringUciOption{"EgtbPath", "", e.loadEndgameTables}
+	e.BookFile = StringUciOption{"Book File", "", e.loadBook}
+	return e
 }
 
 func (e *Engine) GetInfo() (name, version, author string) {
@@ -60,40 +98,199 @@ func (e *Engine) GetInfo() (name, version, author string) {
 
 func (e *Engine) GetOptions() []UciOption {
 	return []UciOption{
-		&e.Hash, &e.Threads, &e.ExperimentSettings}
+		&e.Hash, &e.Threads, &e.MultiPV, &e.Ponder,
+		&e.SingularDepth, &e.SingularMargin, &e.MultiCut,
+		&e.Statistics, &e.LimitStrength, &e.Elo, &e.SkillLevel,
+		&e.Contempt, &e.AnalyseMode, &e.ClearHash, &e.HashFile, &e.TimeControl,
+		&e.SyzygyPath, &e.SyzygyProbeDepth, &e.EgtbPath,
+		&e.OwnBook, &e.BookFile, &e.BookVariety, &e.ExperimentSettings}
 }
 
+// Prepare allocates what the options require. Options changed with setoption
+// take effect at once, Prepare applies fields assigned directly.
 func (e *Engine) Prepare() {
 	if e.transTable == nil || e.transTable.megabytes != e.Hash.Value {
-		e.transTable = NewTransTable(e.Hash.Value)
+		e.resizeTransTable()
 	}
 	if len(e.tree) != e.Threads.Value {
-		e.tree = NewTree(e, e.Threads.Value)
+		e.resizeTree()
+	}
+	if e.staticEvaluator == nil {
+		e.resetEvaluation()
 	}
-	if e.evaluator == nil {
-		e.evaluator = NewEvaluation(e.ExperimentSettings.Value)
+	if e.tablebasesPath != e.SyzygyPath.Value {
+		e.loadTablebases()
+	}
+	if e.endgameTablesPath != e.EgtbPath.Value {
+		e.loadEndgameTables()
+	}
+	if e.bookPath != e.BookFile.Value {
+		e.loadBook()
+	}
+}
+
+func (e *Engine) resizeTransTable() {
+	// Release the old table before allocating the new one.
+	e.transTable = nil
+	e.transTable = NewTransTable(e.Hash.Value)
+}
+
+func (e *Engine) clearTransTable() {
+	if e.transTable != nil {
+		e.transTable.Clear()
 	}
 }
 
+func (e *Engine) resizeTree() {
+	e.nodeCounters = make([]nodeCounter, e.Threads.Value)
+	e.tree = NewTree(e, e.Threads.Value)
+}
+
+func (e *Engine) resetEvaluation() {
+	e.staticEvaluator = NewEvaluation(e.ExperimentSettings.Value)
+	e.evaluator = e.staticEvaluator
+}
+
 func (e *Engine) Search(searchParams SearchParams) SearchInfo {
 	var p = searchParams.Positions[len(searchParams.Positions)-1]
-	e.timeManager = NewTimeManager(searchParams.Limits, TimeControlBasic,
-		p.WhiteMove, searchParams.CancellationToken)
+	e.Prepare()
+	if move := e.bookMove(p, searchParams.Limits); move != MoveEmpty {
+		return SearchInfo{MainLine: []Move{move}}
+	}
+	e.timeManager = NewTimeManager(searchParams.Limits, timeControlStrategies[e.TimeControl.Value],
+		p.WhiteMove, searchParams.CancellationToken, searchParams.PonderToken)
 	defer e.timeManager.Close()
 
-	e.Prepare()
+	for i := range e.nodeCounters {
+		e.nodeCounters[i] = nodeCounter{}
+	}
+	e.timeManager.counters = e.nodeCounters
+	e.prepareSkill()
+	if e.endgameTables != nil {
+		e.evaluator = &egtbEvaluator{Evaluator: e.evaluator, tables: e.endgameTables}
+	}
 	e.clearKillers()
-	e.historyTable.Clear()
+	e.initStats()
+	e.historyTable.Age()
 	e.transTable.PrepareNewSearch()
 	if e.ClearTransTable {
 		e.transTable.Clear()
 	}
 	e.historyKeys = PositionsToHistoryKeys(searchParams.Positions)
+	e.contempt = e.rootContempt(p)
 	for i := 0; i < len(e.tree); i++ {
 		e.tree[i][0].Position = p
 	}
-	var ctx = &e.tree[0][0]
-	return ctx.IterateSearch(searchParams.Progress)
+	var progress = searchParams.Progress
+	if progress != nil && e.skillEnabled() {
+		progress = e.skillProgress(progress)
+	}
+	var stopHeartbeat = func() {}
+	if progress != nil {
+		progress, stopHeartbeat = e.startHeartbeat(progress)
+	}
+	var results = make([]SearchInfo, len(e.tree))
+	ParallelDo(len(e.tree), func(threadIndex int) {
+		var ctx = &e.tree[threadIndex][0]
+		if threadIndex == 0 {
+			results[threadIndex] = ctx.IterateSearch(searchParams.Limits, progress)
+			ctx.counter.publish()
+			e.timeManager.WaitForStop()
+			e.timeManager.Stop()
+		} else {
+			results[threadIndex] = ctx.IterateSearch(searchParams.Limits, nil)
+			ctx.counter.publish()
+		}
+	})
+	stopHeartbeat()
+	var result = selectBestResult(results)
+	if len(result.MainLine) == 0 {
+		// search stopped before root moves were sorted
+		if ml := GenerateLegalMoves(p); len(ml) > 0 {
+			result.MainLine = []Move{ml[0]}
+		}
+	}
+	if e.skillEnabled() && len(result.Lines) > 1 {
+		var line = e.pickSkillLine(result.Lines)
+		result.Score = line.Score
+		result.MainLine = line.MainLine
+		result.Lines = e.reportedLines(result.Lines)
+	}
+	result.Time = e.timeManager.ElapsedMilliseconds()
+	result.Nodes = e.timeManager.Nodes()
+	result.HashFull = e.transTable.HashFull()
+	result.TBHits = e.timeManager.TBHits()
+	result.Stats = e.collectStats()
+	if len(result.MainLine) == 1 {
+		if ponderMove := e.ponderMoveFromTT(p, result.MainLine[0]); ponderMove != MoveEmpty {
+			result.MainLine = append(result.MainLine, ponderMove)
+		}
+	}
+	return result
+}
+
+// HeartbeatInterval is how often nodes and nps are reported
+// when the search produces no new principal variation.
+const HeartbeatInterval = time.Second
+
+// startHeartbeat returns a progress function that is safe to call from several goroutines
+// and also reports search statistics every HeartbeatInterval until stop is called.
+func (e *Engine) startHeartbeat(progress func(SearchInfo)) (
+	safeProgress func(SearchInfo), stop func()) {
+	var mu sync.Mutex
+	safeProgress = func(si SearchInfo) {
+		si.HashFull = e.transTable.HashFull()
+		si.TBHits = e.timeManager.TBHits()
+		mu.Lock()
+		defer mu.Unlock()
+		progress(si)
+	}
+	var ticker = time.NewTicker(HeartbeatInterval)
+	var done = make(chan struct{})
+	var finished = make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				safeProgress(SearchInfo{
+					Time:  e.timeManager.ElapsedMilliseconds(),
+					Nodes: e.timeManager.Nodes(),
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+	stop = func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+	return
+}
+
+func (e *Engine) ponderMoveFromTT(p *Position, bestMove Move) Move {
+	var child = &Position{}
+	if !p.MakeMove(bestMove, child) {
+		return MoveEmpty
+	}
+	var _, _, _, _, ttMove, ok = e.transTable.Read(child)
+	if !ok || ttMove == MoveEmpty {
+		return MoveEmpty
+	}
+	for _, move := range GenerateLegalMoves(child) {
+		if move == ttMove {
+			return move
+		}
+	}
+	return MoveEmpty
+}
+
+// NewGame forgets everything learned in the previous game.
+func (e *Engine) NewGame() {
+	e.historyTable.Clear()
+	e.clearTransTable()
 }
 
 func (e *Engine) clearKillers() {
@@ -106,6 +303,33 @@ func (e *Engine) clearKillers() {
 	}
 }
 
+// initStats gives every thread its own counters, so threads do not share cache lines.
+func (e *Engine) initStats() {
+	for i := range e.tree {
+		var stats *SearchStats
+		if e.Statistics.Value {
+			stats = &SearchStats{}
+		}
+		for j := range e.tree[i] {
+			e.tree[i][j].Stats = stats
+		}
+	}
+}
+
+// collectStats sums counters of all threads.
+// Iterations are taken from the main thread.
+func (e *Engine) collectStats() *SearchStats {
+	if !e.Statistics.Value {
+		return nil
+	}
+	var result = &SearchStats{}
+	for i := range e.tree {
+		result.Add(e.tree[i][0].Stats)
+	}
+	result.Iterations = e.tree[0][0].Stats.Iterations
+	return result
+}
+
 func PositionsToHistoryKeys(positions []*Position) []uint64 {
 	var result []uint64
 	for _, p := range positions {
@@ -138,6 +362,7 @@ func NewSearchContext(engine *Engine, thread, height int) searchContext {
 		Engine:             engine,
 		Thread:             thread,
 		Height:             height,
+		counter:            &engine.nodeCounters[thread],
 		Position:           &Position{},
 		QuietsSearched:     make([]Move, 0, MAX_MOVES),
 		PrincipalVariation: make([]Move, 0, MAX_HEIGHT),
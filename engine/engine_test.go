@@ -1,7 +1,20 @@
 package engine
 
 import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/CounterGo/syzygy"
 )
 
 //https://chessprogramming.wikispaces.com/Perft+Results
@@ -67,6 +80,97 @@ func Perft(p *Position, depth int) int {
 	return result
 }
 
+func TestStagedPerft(t *testing.T) {
+	var tests = []struct {
+		fen   string
+		depth int
+		nodes int
+	}{
+		{InitialPositionFen, 4, 197281},
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq -", 3, 97862},
+		{"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - -", 5, 674624},
+		{"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", 4, 422333},
+		{"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", 3, 62379},
+	}
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.Prepare()
+	for _, test := range tests {
+		var ctx = &e.tree[0][0]
+		ctx.Position = NewPositionFromFEN(test.fen)
+		var nodes = ctx.stagedPerft(test.depth)
+		if nodes != test.nodes {
+			t.Error(test.fen, test.nodes, nodes)
+		}
+	}
+}
+
+// stagedPerft walks the tree with the staged move iterator and uses
+// the previous best move and killers of each node as hash and killer moves.
+func (ctx *searchContext) stagedPerft(depth int) int {
+	var result = 0
+	var child = ctx.Next()
+	ctx.InitMoves(ctx.Killer2)
+	for {
+		var move = ctx.NextMove()
+		if move == MoveEmpty {
+			break
+		}
+		if ctx.Position.MakeMove(move, child.Position) {
+			if depth > 1 {
+				result += child.stagedPerft(depth - 1)
+			} else {
+				result++
+			}
+			ctx.Killer2 = ctx.Killer1
+			ctx.Killer1 = move
+		}
+	}
+	return result
+}
+
+func TestStagedMoves(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.Prepare()
+	var ctx = &e.tree[0][0]
+	var pool []Move
+	for _, fen := range testFENs {
+		pool = append(pool, GenerateLegalMoves(NewPositionFromFEN(fen))...)
+	}
+	var child = &Position{}
+	for _, fen := range testFENs {
+		var p = NewPositionFromFEN(fen)
+		var legalMoves = GenerateLegalMoves(p)
+		for _, move := range pool {
+			var legal = p.IsPseudoLegal(move) && p.MakeMove(move, child)
+			if legal != (findMoveIndex(legalMoves, move) != -1) {
+				t.Error(fen, move, legal)
+			}
+		}
+		for i, hashMove := range pool[:20] {
+			ctx.Position = p
+			ctx.Killer1 = pool[len(pool)-1-i]
+			ctx.Killer2 = pool[i*7%len(pool)]
+			ctx.InitMoves(hashMove)
+			var moves []Move
+			for {
+				var move = ctx.NextMove()
+				if move == MoveEmpty {
+					break
+				}
+				if p.MakeMove(move, child) {
+					moves = append(moves, move)
+				}
+			}
+			if len(diffMoves(moves, legalMoves)) != 0 || len(diffMoves(legalMoves, moves)) != 0 ||
+				containsRepeats(moves) {
+				t.Error(fen, hashMove, moves, legalMoves)
+			}
+		}
+	}
+}
+
 func TestEval(t *testing.T) {
 	var e = NewEvaluation(false)
 	for _, fen := range testFENs {
@@ -97,6 +201,18 @@ func MirrorPosition(p *Position) *Position {
 		p.Rule50)
 }
 
+func TestWrongFEN(t *testing.T) {
+	for _, fen := range []string{
+		"8/8/8/8/8/8/8/8 w - - 0 1",
+		"P3k3/8/8/8/8/8/8/4K3 w - - 0 1",
+		"4k3/8/8/8/8/8/8/4K2p b - - 0 1",
+	} {
+		if p := NewPositionFromFEN(fen); p != nil {
+			t.Error(fen, p)
+		}
+	}
+}
+
 func TestSEE(t *testing.T) {
 	var buffer [MAX_MOVES]Move
 	var child = &Position{}
@@ -115,6 +231,12 @@ func TestSEE(t *testing.T) {
 			if directSEE != see {
 				t.Error(test, move.String(), directSEE, see)
 			}
+			var value = SEE(p, move)
+			for _, threshold := range []int{-500, -100, 0, 1, 100, 300, 500} {
+				if SEEThreshold(p, move, threshold) != (value >= threshold) {
+					t.Error(test, move.String(), threshold, value)
+				}
+			}
 		}
 	}
 }
@@ -176,16 +298,548 @@ func TestTransTable(t *testing.T) {
 	var p = NewPositionFromFEN(InitialPositionFen)
 	var depth = 5
 	var score = 5
+	var eval = -17
 	var bound = Lower
 	var move = MoveEmpty
-	transTable.Update(p, depth, score, bound, move)
-	var ttDepth, ttScore, ttBound, ttMove, ttOk = transTable.Read(p)
-	if !ttOk || depth != ttDepth || score != ttScore ||
+	transTable.Update(p, depth, score, eval, bound, move)
+	var ttDepth, ttScore, ttEval, ttBound, ttMove, ttOk = transTable.Read(p)
+	if !ttOk || depth != ttDepth || score != ttScore || eval != ttEval ||
 		bound != ttBound || move != ttMove {
 		t.Error()
 	}
 }
 
+func TestTransTableSizes(t *testing.T) {
+	for _, megabytes := range []int{1, 3, 5, 100} {
+		var tt = NewTransTable(megabytes)
+		if len(tt.entries)*16 != megabytes*1024*1024 {
+			t.Error(megabytes, len(tt.entries))
+		}
+		// every position of a game is found after it was stored
+		var positions []*Position
+		var p = NewPositionFromFEN(InitialPositionFen)
+		for i := 0; i < 200; i++ {
+			positions = append(positions, p)
+			var ml = GenerateLegalMoves(p)
+			if len(ml) == 0 {
+				break
+			}
+			var child = &Position{}
+			p.MakeMove(ml[(i*7)%len(ml)], child)
+			p = child
+		}
+		for i, p := range positions {
+			tt.Update(p, i%10, -i, i, Lower|Upper, MoveEmpty)
+		}
+		for i, p := range positions {
+			var depth, score, eval, _, _, ok = tt.Read(p)
+			if !ok || depth != i%10 || score != -i || eval != i {
+				t.Error(megabytes, i, ok, depth, score, eval)
+			}
+		}
+	}
+}
+
+func TestTransTableReplace(t *testing.T) {
+	var tt = NewTransTable(1)
+	var p = NewPositionFromFEN(InitialPositionFen)
+	var move = ParseMove("e2e4")
+	tt.Update(p, 10, 50, 10, Lower, move)
+	// a shallow bound replaces a deep entry, the move is kept
+	tt.Update(p, 2, 80, 10, Upper, MoveEmpty)
+	if depth, score, _, bound, ttMove, _ := tt.Read(p); depth != 2 || score != 80 || bound != Upper || ttMove != move {
+		t.Error("shallow bound", depth, score, bound, ttMove)
+	}
+	// an exact score replaces
+	tt.Update(p, 1, 70, 10, Lower|Upper, MoveEmpty)
+	if depth, score, _, _, ttMove, _ := tt.Read(p); depth != 1 || score != 70 || ttMove != move {
+		t.Error("exact", depth, score, ttMove)
+	}
+	// an entry of an old search is always replaced
+	tt.PrepareNewSearch()
+	tt.Update(p, 12, 30, 10, Lower, MoveEmpty)
+	tt.PrepareNewSearch()
+	tt.Update(p, 1, 40, 10, Upper, MoveEmpty)
+	if depth, score, _, _, _, _ := tt.Read(p); depth != 1 || score != 40 {
+		t.Error("old search", depth, score)
+	}
+}
+
+func TestSearchLimits(t *testing.T) {
+	var tests = []struct {
+		fen    string
+		limits LimitsType
+		move   string
+		depth  int
+	}{
+		{
+			fen:    InitialPositionFen,
+			limits: LimitsType{Depth: 4},
+			depth:  4,
+		},
+		{
+			fen:    "6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1",
+			limits: LimitsType{Mate: 3},
+			move:   "a1a8",
+		},
+	}
+	var e = NewEngine()
+	for _, test := range tests {
+		var si = e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(test.fen)},
+			Limits:    test.limits,
+		})
+		if test.depth != 0 && si.Depth != test.depth {
+			t.Error(test.fen, si.Depth)
+		}
+		if test.move != "" && si.MainLine[0].String() != test.move {
+			t.Error(test.fen, si.MainLine[0])
+		}
+		if test.limits.Mate > 0 && si.Score < MateIn(2*test.limits.Mate-1) {
+			t.Error(test.fen, ScoreToUci(si.Score))
+		}
+	}
+}
+
+func TestMultiPV(t *testing.T) {
+	var tests = []struct {
+		fen   string
+		lines int
+	}{
+		{InitialPositionFen, 3},
+		// only two legal moves
+		{"7k/8/8/8/8/8/8/K6r w - - 0 1", 2},
+	}
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.MultiPV.Value = 3
+	for _, test := range tests {
+		var progressLines = 0
+		var si = e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(test.fen)},
+			Limits:    LimitsType{Depth: 5},
+			Progress: func(si SearchInfo) {
+				progressLines = max(progressLines, len(si.Lines))
+			},
+		})
+		if len(si.Lines) != test.lines || progressLines != test.lines {
+			t.Fatal(test.fen, "lines", len(si.Lines), progressLines)
+		}
+		if si.Score != si.Lines[0].Score || si.MainLine[0] != si.Lines[0].MainLine[0] {
+			t.Error(test.fen, "main line is not the first line")
+		}
+		var moves = make(map[Move]bool)
+		for i, line := range si.Lines {
+			if i > 0 && line.Score > si.Lines[i-1].Score {
+				t.Error(test.fen, "lines not sorted", line.Score, si.Lines[i-1].Score)
+			}
+			if moves[line.MainLine[0]] {
+				t.Error(test.fen, "repeated move", line.MainLine[0])
+			}
+			moves[line.MainLine[0]] = true
+		}
+		var infos = si.MultiPVStrings()
+		for i, info := range infos {
+			if !strings.Contains(info, fmt.Sprintf(" multipv %v ", i+1)) {
+				t.Error(test.fen, info)
+			}
+		}
+		if len(infos) != test.lines {
+			t.Error(test.fen, infos)
+		}
+	}
+}
+
+func TestSearchMoves(t *testing.T) {
+	var parseMoves = func(s string) []Move {
+		var result []Move
+		for _, field := range strings.Fields(s) {
+			result = append(result, ParseMove(field))
+		}
+		return result
+	}
+	var tests = []struct {
+		fen         string
+		searchMoves string
+		expected    string
+	}{
+		{InitialPositionFen, "e2e4 g1f3", "e2e4 g1f3"},
+		{InitialPositionFen, "e2e5 g1f3", "g1f3"},
+		{InitialPositionFen, "e2e5", ""},
+		{"7k/4P3/8/8/8/8/8/K7 w - - 0 1", "e7e8n", "e7e8n"},
+	}
+	for _, test := range tests {
+		var ml = GenerateLegalMoves(NewPositionFromFEN(test.fen))
+		var filtered = filterRootMoves(ml, parseMoves(test.searchMoves))
+		var result []string
+		for _, move := range filtered {
+			if findMoveIndex(ml, move) == -1 {
+				t.Error(test.fen, "not a generated move", move)
+			}
+			result = append(result, move.String())
+		}
+		if strings.Join(result, " ") != test.expected {
+			t.Error(test.fen, test.searchMoves, result)
+		}
+	}
+
+	// A single allowed move is searched, illegal moves are ignored.
+	var e = NewEngine()
+	e.Threads.Value = 1
+	for _, test := range []struct{ searchMoves, bestMove string }{
+		{"a2a3", "a2a3"},
+		{"a2a3 h2h3 e2e5", ""},
+	} {
+		var si = e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+			Limits:    LimitsType{Depth: 4, SearchMoves: parseMoves(test.searchMoves)},
+		})
+		if len(si.MainLine) == 0 || si.Depth != 4 {
+			t.Fatal(test.searchMoves, "no search")
+		}
+		if !strings.Contains(test.searchMoves, si.MainLine[0].String()) ||
+			test.bestMove != "" && si.MainLine[0].String() != test.bestMove {
+			t.Error(test.searchMoves, "best move", si.MainLine[0])
+		}
+	}
+}
+
+func TestLazySMP(t *testing.T) {
+	for depth := 1; depth <= 20; depth++ {
+		if skipDepth(0, depth) {
+			t.Error("main thread skips depth", depth)
+		}
+		if skipDepth(1, depth) != (depth%2 != 0) || skipDepth(2, depth) != (depth%2 == 0) {
+			t.Error("first helpers skip depth", depth)
+		}
+	}
+	// Every helper thread skips some iterations, but never more than skipSize in a row.
+	for thread := 1; thread <= len(skipSize); thread++ {
+		var skipped, inRow = 0, 0
+		for depth := 1; depth <= 40; depth++ {
+			if skipDepth(thread, depth) {
+				skipped++
+				inRow++
+				if inRow > skipSize[thread-1] {
+					t.Error("thread", thread, "skips too many depths at", depth)
+				}
+			} else {
+				inRow = 0
+			}
+		}
+		if skipped == 0 {
+			t.Error("thread", thread, "skips nothing")
+		}
+	}
+
+	var mainResult = SearchInfo{Depth: 8, Score: 20, MainLine: []Move{ParseMove("e2e4")}}
+	var tests = []struct {
+		helper SearchInfo
+		isMain bool
+	}{
+		{SearchInfo{Depth: 9, Score: 30, MainLine: []Move{ParseMove("d2d4")}}, false},
+		{SearchInfo{Depth: 9, Score: 10, MainLine: []Move{ParseMove("d2d4")}}, true},
+		{SearchInfo{Depth: 8, Score: 30, MainLine: []Move{ParseMove("d2d4")}}, true},
+		{SearchInfo{Depth: 9, Score: 30}, true},
+	}
+	for _, test := range tests {
+		var best = selectBestResult([]SearchInfo{mainResult, test.helper})
+		if (best.Depth == mainResult.Depth && best.Score == mainResult.Score) != test.isMain {
+			t.Error("selected", best.Depth, best.Score, "main expected", test.isMain)
+		}
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 4
+	var p = NewPositionFromFEN(InitialPositionFen)
+	var si = e.Search(SearchParams{Positions: []*Position{p}, Limits: LimitsType{Depth: 6}})
+	if len(si.MainLine) == 0 || si.Depth < 6 || p.MakeMoveIfLegal(si.MainLine[0]) == nil {
+		t.Error("parallel search", si.Depth, si.MainLine)
+	}
+}
+
+// TestAspirationWindows searches a pawn endgame where the score changes by more than
+// the aspiration window, so that iterations fail low and fail high.
+func TestAspirationWindows(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	var infos []SearchInfo
+	e.Search(SearchParams{
+		Positions: []*Position{NewPositionFromFEN("8/8/8/3k4/8/2P5/4P3/4K3 w - - 0 1")},
+		Limits:    LimitsType{Depth: 9},
+		Progress: func(si SearchInfo) {
+			if len(si.MainLine) != 0 {
+				infos = append(infos, si)
+			}
+		},
+	})
+	var bounds = map[int]string{Lower: "lowerbound", Upper: "upperbound"}
+	var failed = make(map[int]bool)
+	var bestMove = MoveEmpty
+	for i, si := range infos {
+		if si.Bound == 0 {
+			bestMove = si.MainLine[0]
+			continue
+		}
+		failed[si.Bound] = true
+		// fail low keeps the best move of the previous iteration
+		if si.Bound == Upper && si.MainLine[0] != bestMove {
+			t.Error("fail low move", si.MainLine[0], bestMove)
+		}
+		if si.Depth < AspirationMinDepth || !strings.Contains(si.String(), " "+bounds[si.Bound]+" ") {
+			t.Error("bound", si.String())
+		}
+		// the iteration is searched again until the score is inside the window
+		var exact = false
+		for _, next := range infos[i+1:] {
+			if next.Depth == si.Depth && next.Bound == 0 {
+				exact = true
+			}
+		}
+		if !exact {
+			t.Error("no exact score after", si.String())
+		}
+	}
+	if !failed[Lower] || !failed[Upper] {
+		t.Error("expected fail low and fail high", failed)
+	}
+}
+
+// TestSingularExtension checks the search without the hash move that decides
+// about singular extensions.
+func TestSingularExtension(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.Prepare()
+	e.timeManager = NewTimeManager(LimitsType{Infinite: true}, nil, true, nil, nil)
+	var ctx = &e.tree[0][0]
+	var search = func(fen, excluded string, alpha, beta int) (score int, stored bool) {
+		e.transTable.Clear()
+		ctx.Position = NewPositionFromFEN(fen)
+		if excluded != "" {
+			ctx.ExcludedMove = filterRootMoves(GenerateLegalMoves(ctx.Position),
+				[]Move{ParseMove(excluded)})[0]
+		}
+		score = ctx.AlphaBeta(alpha, beta, 4)
+		ctx.ExcludedMove = MoveEmpty
+		_, _, _, _, _, stored = e.transTable.Read(ctx.Position)
+		return
+	}
+	// Without the capture of the queen white is worse.
+	var fen = "k7/8/8/3q4/8/8/8/K2R4 w - - 0 1"
+	var best, stored = search(fen, "", -VALUE_INFINITE, VALUE_INFINITE)
+	if best < 3*PawnValue || !stored {
+		t.Error("best", best, stored)
+	}
+	var other, otherStored = search(fen, "d1d5", -VALUE_INFINITE, VALUE_INFINITE)
+	if other >= 0 || otherStored {
+		t.Error("excluded", other, otherStored)
+	}
+	// The only legal move is excluded: the node fails low, it is not a mate.
+	if score, stored := search("k7/8/8/8/8/8/1r6/K7 w - - 0 1", "a1b2", -100, 100); score != -100 || stored {
+		t.Error("only move excluded", score, stored)
+	}
+
+	// SingularDepth 0 turns singular extensions off.
+	var nodes = func(singularDepth int) int64 {
+		var e = NewEngine()
+		e.Threads.Value = 1
+		e.SingularDepth.Value = singularDepth
+		return e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+			Limits:    LimitsType{Depth: 9},
+		}).Nodes
+	}
+	if nodes(0) == nodes(4) {
+		t.Error("singular extensions do not change the search")
+	}
+}
+
+func TestHistoryTable(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.Prepare()
+	var move = func(p *Position, s string) Move {
+		return filterRootMoves(GenerateLegalMoves(p), []Move{ParseMove(s)})[0]
+	}
+	// the node after 1.e4 e5, white to move
+	var tree = e.tree[0]
+	tree[0].Position = NewPositionFromFEN(InitialPositionFen)
+	tree[1].Position = tree[0].Position.MakeMoveIfLegal(ParseMove("e2e4"))
+	tree[2].Position = tree[1].Position.MakeMoveIfLegal(ParseMove("e7e5"))
+	var ctx = &tree[2]
+	var p = ctx.Position
+	var prevMove1, prevMove2 = ctx.PrevMoves()
+	if prevMove1.String() != "e7e5" || prevMove2.String() != "e2e4" {
+		t.Fatal("previous moves", prevMove1, prevMove2)
+	}
+	var best, other = move(p, "g1f3"), move(p, "b1c3")
+	ctx.QuietsSearched = []Move{move(p, "d2d4"), other, best}
+	var ht = &e.historyTable
+	ht.Update(ctx, best, 5)
+	if ctx.Killer1 != best {
+		t.Error("killer", ctx.Killer1)
+	}
+	if counterMove := ht.CounterMove(p.WhiteMove, prevMove1); counterMove != best {
+		t.Error("counter move", counterMove)
+	}
+	var score = ht.Score(p.WhiteMove, best)
+	var continuation = ht.ContinuationScore(p.WhiteMove, prevMove1, prevMove2, best)
+	if score <= ht.Score(p.WhiteMove, other) || continuation <= 0 ||
+		ht.ContinuationScore(p.WhiteMove, prevMove1, prevMove2, other) >= 0 {
+		t.Error("history scores", score, continuation)
+	}
+
+	// Age keeps what was learned with less weight.
+	ht.Age()
+	if agedScore := ht.Score(p.WhiteMove, best); agedScore <= ht.Score(p.WhiteMove, other) {
+		t.Error("aged history", agedScore)
+	}
+	if aged := ht.ContinuationScore(p.WhiteMove, prevMove1, prevMove2, best); aged <= 0 || aged >= continuation {
+		t.Error("aged continuation", aged, continuation)
+	}
+	if ht.CounterMove(p.WhiteMove, prevMove1) != best {
+		t.Error("aged counter move")
+	}
+
+	ht.Clear()
+	if ht.CounterMove(p.WhiteMove, prevMove1) != MoveEmpty ||
+		ht.Score(p.WhiteMove, best) != ht.Score(p.WhiteMove, other) ||
+		ht.ContinuationScore(p.WhiteMove, prevMove1, prevMove2, best) != 0 {
+		t.Error("clear")
+	}
+}
+
+func TestSearchStats(t *testing.T) {
+	var stats = &SearchStats{
+		Nodes: 900, QNodes: 100,
+		TTProbes: 200, TTHits: 50, TTCutoffs: 20,
+		NullMoveTries: 10, NullMoveCutoffs: 4,
+		FailHighs: 8, FirstMoveFailHighs: 6,
+		Iterations: []IterationStats{{1, 100}, {2, 400}, {3, 1000}},
+	}
+	var total = &SearchStats{}
+	total.Add(stats)
+	total.Add(stats)
+	total.Iterations = stats.Iterations
+	var expected = []string{
+		"nodes 2000 qnodes 200 (10.0%)",
+		"tt probes 400 hits 25.0% cutoffs 10.0%",
+		"null move tries 20 cutoffs 40.0%",
+		"lmr searches 0 re-searches 0.0%",
+		"fail highs 16 first move 75.0%",
+		"depth 1 nodes 100",
+		"depth 2 nodes 300 branching 3.00",
+		"depth 3 nodes 600 branching 2.00",
+	}
+	if lines := total.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("lines\n%v\nexpected\n%v", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 2
+	var search = func() SearchInfo {
+		return e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+			Limits:    LimitsType{Depth: 5},
+		})
+	}
+	if si := search(); si.Stats != nil {
+		t.Error("statistics off")
+	}
+	e.Statistics.Value = true
+	var si = search()
+	if si.Stats == nil || si.Stats.Nodes == 0 || si.Stats.Nodes+si.Stats.QNodes > si.Nodes {
+		t.Fatal("statistics", si.Stats, si.Nodes)
+	}
+	var depths []int
+	for _, it := range si.Stats.Iterations {
+		depths = append(depths, it.Depth)
+	}
+	if !reflect.DeepEqual(depths, []int{2, 3, 4, 5}) {
+		t.Error("iterations", depths)
+	}
+}
+
+func TestSearchInfoString(t *testing.T) {
+	var pv = []Move{ParseMove("e2e4"), ParseMove("e7e5")}
+	var tests = []struct {
+		si       SearchInfo
+		expected string
+	}{
+		{
+			SearchInfo{Depth: 10, SelDepth: 15, Score: 35, Nodes: 2000, Time: 999,
+				HashFull: 123, TBHits: 4, MainLine: pv},
+			"info depth 10 seldepth 15 score cp 35 nodes 2000 time 999 nps 2000 hashfull 123 tbhits 4 pv e2e4 e7e5",
+		},
+		{
+			SearchInfo{Depth: 7, SelDepth: 9, Score: MateIn(3), Bound: Lower, MainLine: pv},
+			"info depth 7 seldepth 9 score mate 2 lowerbound nodes 0 time 0 nps 0 hashfull 0 tbhits 0 pv e2e4 e7e5",
+		},
+		{
+			SearchInfo{Depth: 12, CurrMove: ParseMove("g1f3"), CurrMoveNumber: 3, Nodes: 100, Time: 5000},
+			"info depth 12 currmove g1f3 currmovenumber 3",
+		},
+		{
+			SearchInfo{Nodes: 5000, Time: 1999, HashFull: 7},
+			"info nodes 5000 time 1999 nps 2500 hashfull 7 tbhits 0",
+		},
+	}
+	for _, test := range tests {
+		if s := test.si.String(); s != test.expected {
+			t.Errorf("%v\nexpected\n%v", s, test.expected)
+		}
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 1
+	var si = e.Search(SearchParams{
+		Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+		Limits:    LimitsType{Depth: 6},
+	})
+	if si.SelDepth < si.Depth || si.HashFull <= 0 {
+		t.Error("seldepth", si.SelDepth, "hashfull", si.HashFull)
+	}
+}
+
+// TestSearchNodes searches to a fixed depth with one thread. The staged move iterator
+// must find the best move, and the same search must visit the same number of nodes.
+func TestSearchNodes(t *testing.T) {
+	var tests = []struct {
+		fen   string
+		depth int
+		move  string
+	}{
+		{InitialPositionFen, 7, ""},
+		{"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", 5, ""},
+		{"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", 8, ""},
+		{"6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1", 4, "a1a8"},
+		{"k7/8/8/3q4/8/8/8/K2R4 w - - 0 1", 4, "d1d5"},
+		{"8/4P1k1/8/8/8/8/8/K7 w - - 0 1", 4, "e7e8q"},
+	}
+	var search = func(fen string, depth int) SearchInfo {
+		var e = NewEngine()
+		e.Threads.Value = 1
+		return e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(fen)},
+			Limits:    LimitsType{Depth: depth},
+		})
+	}
+	for _, test := range tests {
+		var si = search(test.fen, test.depth)
+		if len(si.MainLine) == 0 {
+			t.Fatal(test.fen, "no best move")
+		}
+		if test.move != "" && si.MainLine[0].String() != test.move {
+			t.Error(test.fen, "best move", si.MainLine[0])
+		}
+		var again = search(test.fen, test.depth)
+		if again.MainLine[0] != si.MainLine[0] || again.Score != si.Score || again.Nodes != si.Nodes {
+			t.Error(test.fen, si.MainLine[0], again.MainLine[0], si.Nodes, again.Nodes)
+		}
+	}
+}
+
 const (
 	BB_A1 = uint64(1) << iota
 	BB_B1
@@ -452,3 +1106,871 @@ var testFENs = []string{
 	"4k3/ppp3pp/8/8/4N3/8/P3R3/4K3 w - - 0 1",
 	"rnbqk3/p7/2P5/1B6/8/8/8/4K3 w q - 0 1",
 }
+
+func TestContempt(t *testing.T) {
+	var e = NewEngine()
+	e.Contempt.Value = 40
+	var tests = []struct {
+		fen      string
+		contempt int
+	}{
+		{InitialPositionFen, 40},
+		{"8/5kpp/8/8/8/8/5PPP/6K1 w - - 0 1", 20},
+	}
+	for _, test := range tests {
+		var p = NewPositionFromFEN(test.fen)
+		if contempt := e.rootContempt(p); contempt != test.contempt {
+			t.Error(test.fen, contempt, test.contempt)
+		}
+	}
+	e.AnalyseMode.Value = true
+	if contempt := e.rootContempt(NewPositionFromFEN(InitialPositionFen)); contempt != 0 {
+		t.Error("analyse mode", contempt)
+	}
+}
+
+func TestSkillLevel(t *testing.T) {
+	const level = 2
+	var e *Engine
+	var search = func(seed int64) (SearchInfo, int) {
+		e = NewEngine()
+		e.Threads.Value = 1
+		e.SkillLevel.Value = level
+		e.RandomSeed = seed
+		var maxLines = 0
+		var si = e.Search(SearchParams{
+			Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+			Limits:    LimitsType{MoveTime: 10000},
+			Progress: func(si SearchInfo) {
+				maxLines = max(maxLines, len(si.Lines))
+			},
+		})
+		return si, maxLines
+	}
+	var si1, maxLines = search(1)
+	if len(si1.MainLine) == 0 {
+		t.Fatal("no best move")
+	}
+	if si1.Nodes > skillNodes(level)+2*NodeLimitCheckInterval {
+		t.Error("node limit", si1.Nodes, skillNodes(level))
+	}
+	// The extra lines to choose from are not reported.
+	if maxLines > 1 || len(si1.Lines) > 1 {
+		t.Error("reported lines", maxLines, len(si1.Lines))
+	}
+	var si2, _ = search(1)
+	if si1.MainLine[0] != si2.MainLine[0] || si1.Score != si2.Score || si1.Nodes != si2.Nodes {
+		t.Error("same seed, different search", si1.MainLine, si2.MainLine, si1.Nodes, si2.Nodes)
+	}
+	// The noisy evaluation is not cached for later searches.
+	for i := range e.transTable.entries {
+		var key, data = e.transTable.entries[i].load()
+		var _, bound, _ = unpackKey(key)
+		if _, _, eval := unpackData(data); bound != 0 && eval != VALUE_INFINITE {
+			t.Fatal("cached evaluation", eval)
+		}
+	}
+}
+
+func TestPickSkillLine(t *testing.T) {
+	var ml = GenerateLegalMoves(NewPositionFromFEN(InitialPositionFen))
+	var lines []SearchLine
+	for i, score := range []int{20, 10, 0, -10} {
+		lines = append(lines, SearchLine{Score: score, MainLine: []Move{ml[i]}})
+	}
+	var pickCounts = func(level int, lines []SearchLine) map[Move]int {
+		var e = NewEngine()
+		e.SkillLevel.Value = level
+		e.RandomSeed = 1
+		e.initRandom()
+		var result = make(map[Move]int)
+		for i := 0; i < 100; i++ {
+			result[e.pickSkillLine(lines).MainLine[0]]++
+		}
+		return result
+	}
+	// The weakest level often plays worse moves of close lines.
+	if counts := pickCounts(0, lines); len(counts) < 2 || counts[ml[0]] == 100 {
+		t.Error("level 0 picks", counts)
+	}
+	// Blunders are rare for strong levels.
+	lines[1].Score, lines[2].Score, lines[3].Score = -500, -600, -700
+	if counts := pickCounts(MaxSkillLevel-1, lines); counts[ml[0]] != 100 {
+		t.Error("level 19 picks", counts)
+	}
+	if counts := pickCounts(0, lines[:1]); counts[ml[0]] != 100 {
+		t.Error("single line", counts)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 4
+	var ct = &CancellationToken{}
+	var done = make(chan SearchInfo)
+	go func() {
+		done <- e.Search(SearchParams{
+			Positions:         []*Position{NewPositionFromFEN(InitialPositionFen)},
+			Limits:            LimitsType{Infinite: true},
+			CancellationToken: ct,
+		})
+	}()
+	var before = ct.Done()
+	time.Sleep(200 * time.Millisecond)
+	ct.Cancel()
+	for _, ch := range []<-chan struct{}{before, ct.Done()} {
+		select {
+		case <-ch:
+		default:
+			t.Error("done channel is not closed")
+		}
+	}
+	select {
+	case si := <-done:
+		if len(si.MainLine) == 0 {
+			t.Fatal("no best move")
+		}
+		var child = &Position{}
+		if !NewPositionFromFEN(InitialPositionFen).MakeMove(si.MainLine[0], child) {
+			t.Error("illegal best move", si.MainLine[0])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("search did not stop")
+	}
+}
+
+// Infinite and ponder searches finish their iterations but return the best move
+// only after stop, or after ponderhit for a ponder search.
+func TestSearchWaitsForStop(t *testing.T) {
+	var tests = []struct {
+		limits    LimitsType
+		ponderHit bool
+	}{
+		{LimitsType{Infinite: true, Depth: 2}, false},
+		{LimitsType{Ponder: true, Depth: 2}, false},
+		{LimitsType{Ponder: true, Depth: 2}, true},
+	}
+	var e = NewEngine()
+	e.Threads.Value = 2
+	for _, test := range tests {
+		var ct = &CancellationToken{}
+		var pt = &PonderToken{}
+		var done = make(chan SearchInfo, 1)
+		go func() {
+			done <- e.Search(SearchParams{
+				Positions:         []*Position{NewPositionFromFEN(InitialPositionFen)},
+				Limits:            test.limits,
+				CancellationToken: ct,
+				PonderToken:       pt,
+			})
+		}()
+		select {
+		case <-done:
+			t.Fatal(test.limits, "returned before stop")
+		case <-time.After(200 * time.Millisecond):
+		}
+		if test.ponderHit {
+			pt.PonderHit()
+		} else {
+			ct.Cancel()
+		}
+		select {
+		case si := <-done:
+			if len(si.MainLine) == 0 || si.Depth != 2 {
+				t.Error(test.limits, "result", si.MainLine, si.Depth)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal(test.limits, "search did not stop")
+		}
+	}
+}
+
+func TestUciOptions(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.Search(SearchParams{
+		Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+		Limits:    LimitsType{Depth: 6},
+	})
+	if e.transTable.HashFull() == 0 {
+		t.Fatal("empty hash after search")
+	}
+	if err := e.ClearHash.Set(""); err != nil || e.transTable.HashFull() != 0 {
+		t.Error("clear hash", err, e.transTable.HashFull())
+	}
+	if err := e.Hash.Set("8"); err != nil || e.transTable.megabytes != 8 {
+		t.Error("hash resize", err)
+	}
+	if err := e.Hash.Set("1"); err == nil || e.Hash.Value != 8 {
+		t.Error("hash out of range", err, e.Hash.Value)
+	}
+	if err := e.Threads.Set("1"); err != nil || len(e.tree) != 1 {
+		t.Error("threads", err, len(e.tree))
+	}
+	if err := e.TimeControl.Set("cautious"); err != nil || e.TimeControl.Value != "Cautious" {
+		t.Error("combo", err, e.TimeControl.Value)
+	}
+	if err := e.TimeControl.Set("foo"); err == nil || e.TimeControl.Value != "Cautious" {
+		t.Error("combo wrong value", err, e.TimeControl.Value)
+	}
+	if err := e.ExperimentSettings.Set("maybe"); err == nil {
+		t.Error("check wrong value")
+	}
+	var path = StringUciOption{"Path", "", nil}
+	var changes = 0
+	path.OnChange = func() { changes++ }
+	path.Set("/tmp/a b")
+	path.Set("/tmp/a b")
+	if path.Value != "/tmp/a b" || changes != 1 {
+		t.Error("string", path.Value, changes)
+	}
+	path.Set("<empty>")
+	if path.Value != "" || changes != 2 {
+		t.Error("string empty", path.Value, changes)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.HashFile.Value = filepath.Join(t.TempDir(), "counter.hash")
+	e.Search(SearchParams{
+		Positions: []*Position{NewPositionFromFEN(InitialPositionFen)},
+		Limits:    LimitsType{Depth: 6},
+	})
+	if err := e.SaveHash(); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded = NewEngine()
+	loaded.HashFile.Value = e.HashFile.Value
+	if err := loaded.LoadHash(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.transTable.generation != e.transTable.generation ||
+		!reflect.DeepEqual(loaded.transTable.entries, e.transTable.entries) {
+		t.Error("loaded table differs")
+	}
+
+	var data, _ = os.ReadFile(e.HashFile.Value)
+	var tests = []struct {
+		name  string
+		data  []byte
+		clear bool
+	}{
+		{"magic", append([]byte("XXXX"), data[4:]...), false},
+		{"version", patchBytes(data, 8, 99), false},
+		{"zobrist", patchBytes(data, 12, 1), false},
+		{"truncated header", data[:20], false},
+		{"truncated entries", data[:len(data)/2], true},
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(loaded.HashFile.Value, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.LoadHash(); err == nil {
+			t.Error(test.name, "loaded")
+		}
+		if cleared := loaded.transTable.HashFull() == 0 &&
+			loaded.transTable.entries[0] == (transEntry{}); cleared != test.clear {
+			t.Error(test.name, "cleared", cleared)
+		}
+		os.WriteFile(loaded.HashFile.Value, data, 0644)
+		loaded.LoadHash()
+	}
+
+	loaded.Hash.Set("8")
+	if err := loaded.LoadHash(); err == nil {
+		t.Error("loaded table of other size")
+	}
+}
+
+func patchBytes(data []byte, offset int, value byte) []byte {
+	var result = append([]byte(nil), data...)
+	result[offset] ^= value
+	return result
+}
+
+// kxkSolution holds the WDL and DTZ values of an endgame of white king and piece
+// against black king, indexed by tbTestIndex.
+type kxkSolution struct {
+	legal []bool
+	wdl   []int8
+	dtz   []int16
+}
+
+func tbTestIndex(whiteKing, piece, blackKing int, whiteMove bool) int {
+	var result = whiteKing<<12 | piece<<6 | blackKing
+	if !whiteMove {
+		result |= 1 << 18
+	}
+	return result
+}
+
+func kxkPosition(index, piece int) *Position {
+	var p = &Position{EpSquare: SquareNone, WhiteMove: index>>18 == 0}
+	var whiteKing, square, blackKing = index >> 12 & 63, index >> 6 & 63, index & 63
+	if whiteKing == square || whiteKing == blackKing || square == blackKing ||
+		(piece == Pawn && (Rank(square) == Rank1 || Rank(square) == Rank8)) {
+		return nil
+	}
+	xorPiece(p, King, true, whiteKing)
+	xorPiece(p, piece, true, square)
+	xorPiece(p, King, false, blackKing)
+	p.Key = p.ComputeKey()
+	p.Checkers = p.computeCheckers()
+	if !p.isLegal() {
+		return nil
+	}
+	return p
+}
+
+func kxkIndex(p *Position) (index, piece int) {
+	var pieces = p.White &^ p.Kings
+	if pieces == 0 {
+		return 0, Empty
+	}
+	var square = FirstOne(pieces)
+	return tbTestIndex(FirstOne(p.Kings&p.White), square, FirstOne(p.Kings&p.Black), p.WhiteMove),
+		p.WhatPiece(square)
+}
+
+// solveKXK computes the endgame by retrograde analysis, the positions after
+// promotions are looked up in solved, missing endgames are draws.
+func solveKXK(piece int, solved map[int]*kxkSolution) *kxkSolution {
+	const size = 1 << 19
+	const unknown = 100
+	const zeroing = 1 << 20
+	const terminal = 1 << 21
+	var s = &kxkSolution{make([]bool, size), make([]int8, size), make([]int16, size)}
+	var children = make([][]int32, size)
+	var buffer [MAX_MOVES]Move
+	var child Position
+	for i := 0; i < size; i++ {
+		var p = kxkPosition(i, piece)
+		if p == nil {
+			continue
+		}
+		s.legal[i] = true
+		s.wdl[i] = unknown
+		for _, move := range GenerateMoves(p, buffer[:]) {
+			if !p.MakeMove(move, &child) {
+				continue
+			}
+			var code int32
+			var index, childPiece = kxkIndex(&child)
+			if childPiece == piece {
+				code = int32(index)
+			} else if solution := solved[childPiece]; solution != nil {
+				code = terminal | int32(solution.wdl[index]+2)
+			} else {
+				code = terminal | 2
+			}
+			if move.CapturedPiece() != Empty || move.MovingPiece() == Pawn {
+				code |= zeroing
+			}
+			children[i] = append(children[i], code)
+		}
+		if len(children[i]) == 0 {
+			s.wdl[i] = 0
+			if p.IsCheck() {
+				s.wdl[i] = -2
+			}
+		}
+	}
+
+	var childWDL = func(code int32) int8 {
+		if code&terminal != 0 {
+			return int8(code&7) - 2
+		}
+		return s.wdl[code&(zeroing-1)]
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := range s.wdl {
+			if s.wdl[i] != unknown {
+				continue
+			}
+			var allWin = true
+			for _, code := range children[i] {
+				var wdl = childWDL(code)
+				if wdl == -2 {
+					s.wdl[i] = 2
+					changed = true
+					break
+				}
+				allWin = allWin && wdl == 2
+			}
+			if allWin && s.wdl[i] == unknown {
+				s.wdl[i] = -2
+				changed = true
+			}
+		}
+	}
+	for i := range s.wdl {
+		if s.wdl[i] == unknown {
+			s.wdl[i] = 0
+		}
+	}
+
+	// DTZ in plies: a round assigns the positions one ply further from zeroing.
+	var resolved = make([]bool, size)
+	for i := range s.wdl {
+		resolved[i] = s.wdl[i] == 0 || len(children[i]) == 0
+	}
+	for n := int16(1); ; n++ {
+		var found []int
+		var values []int16
+		for i := range s.wdl {
+			if resolved[i] {
+				continue
+			}
+			if s.wdl[i] > 0 {
+				for _, code := range children[i] {
+					var index = code & (zeroing - 1)
+					if childWDL(code) == -2 && (code&zeroing != 0 && n == 1 ||
+						code&(zeroing|terminal) == 0 && resolved[index] && s.dtz[index] == 1-n) {
+						found, values = append(found, i), append(values, n)
+						break
+					}
+				}
+				continue
+			}
+			var longest int16
+			var all = true
+			for _, code := range children[i] {
+				var index = code & (zeroing - 1)
+				if code&zeroing != 0 {
+					longest = max16(longest, 1)
+				} else if resolved[index] {
+					longest = max16(longest, s.dtz[index]+1)
+				} else {
+					all = false
+					break
+				}
+			}
+			if all {
+				found, values = append(found, i), append(values, -longest)
+			}
+		}
+		if len(found) == 0 {
+			break
+		}
+		for j, i := range found {
+			s.dtz[i] = values[j]
+			resolved[i] = true
+		}
+	}
+	return s
+}
+
+func max16(x, y int16) int16 {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// writeKXKTables writes the Syzygy tables of solution, the piece is white.
+func writeKXKTables(t *testing.T, dir, name string, piece int, solution *kxkSolution) {
+	for _, dtz := range []bool{false, true} {
+		var ext = ".rtbw"
+		if dtz {
+			ext = ".rtbz"
+		}
+		var file, err = os.Create(filepath.Join(dir, name+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = syzygy.WriteTable(file, name, dtz, func(p *syzygy.Position) (int, bool) {
+			if solution == nil {
+				return 0, true
+			}
+			var index = tbTestIndex(FirstOne(p.Kings&p.White), FirstOne(p.White&^p.Kings),
+				FirstOne(p.Kings&p.Black), p.WhiteMove)
+			if !solution.legal[index] {
+				return 0, false
+			}
+			if dtz {
+				return int(solution.dtz[index]), true
+			}
+			return int(solution.wdl[index]), true
+		})
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var updateTestdata = flag.Bool("update", false, "write the tables of TestSyzygy to syzygy/testdata")
+
+func TestSyzygy(t *testing.T) {
+	var solved = make(map[int]*kxkSolution)
+	for _, piece := range []int{Queen, Rook, Pawn} {
+		solved[piece] = solveKXK(piece, solved)
+	}
+	var dir = t.TempDir()
+	var testdata = filepath.Join("..", "syzygy", "testdata")
+	for _, path := range []string{dir, testdata} {
+		if path == testdata && !*updateTestdata {
+			continue
+		}
+		writeKXKTables(t, path, "KQvK", Queen, solved[Queen])
+		writeKXKTables(t, path, "KRvK", Rook, solved[Rook])
+		writeKXKTables(t, path, "KPvK", Pawn, solved[Pawn])
+		writeKXKTables(t, path, "KBvK", Bishop, nil)
+		writeKXKTables(t, path, "KNvK", Knight, nil)
+	}
+
+	// The committed tables are compared with the solution, and tables of the
+	// Syzygy generator if SYZYGY_PATH is set.
+	var paths = []string{dir, testdata}
+	if path := os.Getenv("SYZYGY_PATH"); path != "" {
+		paths = append(paths, path)
+	}
+	// Values known from chess theory, independent of solveKXK.
+	var known = []struct {
+		fen      string
+		wdl, dtz int
+	}{
+		// king on the sixth rank in front of the pawn wins
+		{"4k3/8/4K3/4P3/8/8/8/8 w - - 0 1", syzygy.Win, 0},
+		{"4k3/8/4K3/4P3/8/8/8/8 b - - 0 1", syzygy.Loss, 0},
+		// rook pawn
+		{"k7/8/K7/P7/8/8/8/8 w - - 0 1", syzygy.Draw, 0},
+		// stalemates
+		{"4k3/4P3/4K3/8/8/8/8/8 b - - 0 1", syzygy.Draw, 0},
+		{"7k/8/5KQ1/8/8/8/8/8 b - - 0 1", syzygy.Draw, 0},
+		// mate in one and mated
+		{"7k/8/6K1/8/8/8/8/1Q6 w - - 0 1", syzygy.Win, 1},
+		{"Q6k/8/6K1/8/8/8/8/8 b - - 0 1", syzygy.Loss, -1},
+	}
+	for _, path := range paths {
+		var e = NewEngine()
+		e.Threads.Value = 1
+		e.SyzygyPath.Set(path)
+		if e.tablebases == nil || e.tablebases.MaxPieces() < 3 {
+			t.Fatal(e.TablebasesInfo())
+		}
+		for _, test := range known {
+			var p = NewPositionFromFEN(test.fen)
+			var wdl, ok = e.probeWDL(p)
+			var dtz, dtzOK = e.probeDTZ(p)
+			if !ok || !dtzOK || wdl != test.wdl ||
+				(test.dtz != 0 && dtz != test.dtz) || sign(dtz) != sign(test.wdl) {
+				t.Errorf("%v %v: wdl %v dtz %v, expected %v %v", path, test.fen, wdl, dtz, test.wdl, test.dtz)
+			}
+		}
+		for _, piece := range []int{Queen, Rook, Pawn} {
+			var solution = solved[piece]
+			for i := 0; i < len(solution.legal); i += 7 {
+				if !solution.legal[i] {
+					continue
+				}
+				var p = kxkPosition(i, piece)
+				var wdl, ok = e.probeWDL(p)
+				if !ok || wdl != int(solution.wdl[i]) {
+					t.Fatalf("%v %v: wdl %v %v, expected %v", path, p, wdl, ok, solution.wdl[i])
+				}
+				var dtz, dtzOK = e.probeDTZ(p)
+				var expected = int(solution.dtz[i])
+				if wdl == syzygy.Loss && expected == 0 {
+					// mated
+					expected = -1
+				}
+				// Tables of the generator may store the DTZ in moves, one ply longer.
+				var longer = AbsDelta(dtz, 0) - AbsDelta(expected, 0)
+				if !dtzOK || sign(dtz) != sign(expected) ||
+					longer < 0 || longer > 1 || (path == dir && longer != 0) {
+					t.Fatalf("%v %v: dtz %v %v, expected %v", path, p, dtz, dtzOK, expected)
+				}
+			}
+		}
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.SyzygyPath.Value = dir
+
+	// The root is in the tables: only the moves that keep the win are searched.
+	var p = NewPositionFromFEN("8/8/8/4k3/8/8/8/R3K3 w - - 0 1")
+	var result = e.Search(SearchParams{Positions: []*Position{p}, Limits: LimitsType{Depth: 6}})
+	if len(result.MainLine) == 0 || result.TBHits == 0 {
+		t.Fatal("no tablebase hits", result.TBHits)
+	}
+	var child Position
+	p.MakeMove(result.MainLine[0], &child)
+	if wdl, _ := e.probeWDL(&child); wdl != syzygy.Loss {
+		t.Error("move", result.MainLine[0], "does not win")
+	}
+
+	// The search probes after the rook is captured.
+	p = NewPositionFromFEN("8/8/8/8/k7/8/8/r1Q1K3 w - - 0 1")
+	result = e.Search(SearchParams{Positions: []*Position{p}, Limits: LimitsType{Depth: 4}})
+	if result.TBHits == 0 || result.MainLine[0].String() != "c1a1" ||
+		result.Score < VALUE_MATE_IN_MAX_HEIGHT-MAX_HEIGHT {
+		t.Error("wrong search with tablebases", result.TBHits, result.MainLine, result.Score)
+	}
+}
+
+// checkEndgameTable compares every position of a table with the values after its
+// legal moves, like perft checks the move generator. It returns the number of positions.
+func checkEndgameTable(t *testing.T, tables *endgameTables, table *endgameTable) int {
+	var count = 0
+	for idx := 0; idx < table.size; idx++ {
+		var p = table.position(idx)
+		if p == nil {
+			if table.values[idx] != 0 {
+				t.Fatalf("%v: illegal index %v has value %v", table.name, idx, table.values[idx])
+			}
+			continue
+		}
+		count++
+		var ml = GenerateLegalMoves(p)
+		var expected byte
+		if len(ml) == 0 && p.IsCheck() {
+			expected = egtbLoss(0)
+		}
+		var child Position
+		for i, move := range ml {
+			p.MakeMove(move, &child)
+			var v, ok = tables.probe(&child)
+			if !ok {
+				t.Fatalf("%v: no value after %v", p, move)
+			}
+			if i == 0 || egtbRank(egtbParent(v)) > egtbRank(expected) {
+				expected = egtbParent(v)
+			}
+		}
+		if table.values[idx] != expected {
+			t.Fatalf("%v: value %v, expected %v", p, table.values[idx], expected)
+		}
+	}
+	return count
+}
+
+func TestEndgameTables(t *testing.T) {
+	var dir = t.TempDir()
+	var progress strings.Builder
+	if err := BuildEndgameTables(dir, []string{"KQK", "KRK", "KKP", "KRKN"}, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.String() == "" {
+		t.Error("no progress")
+	}
+	var tables, err = openEndgameTables(dir)
+	if err != nil || len(tables.tables) != 6 || tables.maxPieces != 4 {
+		t.Fatal("tables not found", err)
+	}
+	// The longest mates are 10 moves with a queen, 16 moves with a rook
+	// and 40 moves with a rook against a knight.
+	var longestMates = map[string]int{"KQK": 20, "KRK": 32, "KBK": 0, "KNK": 0, "KRKN": 80}
+	for name, table := range tables.tables {
+		if !table.load() {
+			t.Fatal(table.err)
+		}
+		if checkEndgameTable(t, tables, table) == 0 {
+			t.Error(name, "has no positions")
+		}
+		if longest, ok := longestMates[name]; ok && table.stats().longestMate != longest {
+			t.Error(name, "longest mate", table.stats().longestMate, "expected", longest)
+		}
+	}
+
+	// Positions with colours swapped have the same value.
+	for _, table := range tables.tables {
+		for idx := 0; idx < table.size; idx += 3 {
+			if p := table.position(idx); p != nil {
+				if v, ok := tables.probe(MirrorPosition(p)); !ok || v != table.values[idx] {
+					t.Fatalf("%v: mirrored value %v, expected %v", p, v, table.values[idx])
+				}
+			}
+		}
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 1
+	if err := e.EgtbPath.Set(dir); err != nil || e.endgameTables == nil {
+		t.Fatal(e.EndgameTablesInfo())
+	}
+	var p = NewPositionFromFEN("8/8/8/4k3/8/8/8/R3K3 w - - 0 1")
+	var v, _ = tables.probe(p)
+	var _, dtm = egtbResult(v)
+	var result = e.Search(SearchParams{Positions: []*Position{p}, Limits: LimitsType{Depth: 3}})
+	if result.TBHits == 0 || result.Score != MateIn(dtm) {
+		t.Error("wrong search with endgame tables", result.TBHits, result.Score, dtm)
+	}
+	// Evaluations are cached with the tables.
+	if _, ok := e.evaluator.(*egtbEvaluator); !ok || e.cachedEval(25) != 25 {
+		t.Error("evaluation is not cached with endgame tables")
+	}
+	// Mates beyond the search height get known win scores.
+	e.timeManager = &timeManager{}
+	var ctx = &e.tree[0][0]
+	var probeTests = []struct {
+		height, rule50, score int
+	}{
+		{1, 0, MateIn(1 + dtm)},
+		{MAX_HEIGHT - dtm - 1, 100 - dtm, MateIn(MAX_HEIGHT - 1)},
+		{MAX_HEIGHT - dtm, 0, egtbKnownWin - dtm},
+	}
+	for _, test := range probeTests {
+		var probed = *p
+		probed.Rule50 = test.rule50
+		ctx.Position, ctx.Height = &probed, test.height
+		if score, ok := ctx.probeEndgameTables(); !ok || score != test.score {
+			t.Error("wrong probe", test.height, test.rule50, score, test.score)
+		}
+	}
+	// The mate line starts with the capture of the knight, which resets the 50 move counter.
+	var capture = NewPositionFromFEN("4k3/8/8/8/8/8/4K3/n6R w - - 90 1")
+	var captureValue, _ = tables.probe(capture)
+	var captureResult, captureDTM = egtbResult(captureValue)
+	if captureResult != 1 || captureDTM <= 100-capture.Rule50 {
+		t.Fatal("wrong test position", captureResult, captureDTM)
+	}
+	ctx.Position, ctx.Height = capture, 1
+	if score, ok := ctx.probeEndgameTables(); !ok || score != MateIn(1+captureDTM) {
+		t.Error("wrong probe of a win with a capture", score)
+	}
+	var loss = NewPositionFromFEN("8/8/8/4k3/8/8/8/R3K3 b - - 0 1")
+	var lossValue, _ = tables.probe(loss)
+	var _, lossDTM = egtbResult(lossValue)
+	ctx.Position, ctx.Height = loss, MAX_HEIGHT-lossDTM
+	if score, ok := ctx.probeEndgameTables(); !ok || score != -egtbKnownWin+lossDTM {
+		t.Error("wrong probe of a loss", score)
+	}
+
+	var evaluator = &egtbEvaluator{Evaluator: NewEvaluation(false), tables: tables}
+	if score := evaluator.Evaluate(p); score != egtbKnownWin-dtm {
+		t.Error("wrong evaluation", score)
+	}
+
+	e.EgtbPath.Set(filepath.Join(dir, "missing"))
+	if e.endgameTables != nil || e.endgameTablesErr == nil {
+		t.Error("missing directory", e.EndgameTablesInfo())
+	}
+}
+
+// Keys from the Polyglot book format description.
+func TestPolyglotKey(t *testing.T) {
+	var tests = []struct {
+		moves string
+		key   uint64
+	}{
+		{"", 0x463b96181691fc9c},
+		{"e2e4", 0x823c9b50fd114196},
+		{"e2e4 d7d5", 0x0756b94461c50fb0},
+		{"e2e4 d7d5 e4e5", 0x662fafb965db29d4},
+		{"e2e4 d7d5 e4e5 f7f5", 0x22a48b5a8e47ff78},
+		{"e2e4 d7d5 e4e5 f7f5 e1e2", 0x652a607ca3f242c1},
+		{"e2e4 d7d5 e4e5 f7f5 e1e2 e8f7", 0x00fdd303c946bdd9},
+		{"a2a4 b7b5 h2h4 b5b4 c2c4", 0x3c8123ea7b067637},
+		{"a2a4 b7b5 h2h4 b5b4 c2c4 b4c3 a1a3", 0x5c3f9b829b279560},
+	}
+	for _, test := range tests {
+		var p = NewPositionFromFEN(InitialPositionFen)
+		for _, s := range strings.Fields(test.moves) {
+			p = p.MakeMoveIfLegal(ParseMove(s))
+		}
+		if key := PolyglotKey(p); key != test.key {
+			t.Errorf("%v: key %016x, want %016x", test.moves, key, test.key)
+		}
+	}
+}
+
+// writeBook writes a book with entries of move strings and weights
+// for the positions given by fen.
+func writeBook(t *testing.T, entries map[string][]BookEntry) string {
+	var book []polyglotEntry
+	for fen, moves := range entries {
+		var key = PolyglotKey(NewPositionFromFEN(fen))
+		for _, entry := range moves {
+			var m = entry.Move
+			var move = File(m.To()) | Rank(m.To())<<3 | File(m.From())<<6 | Rank(m.From())<<9
+			if m.Promotion() != Empty {
+				move |= (m.Promotion() - Pawn) << 12
+			}
+			book = append(book, polyglotEntry{key, uint16(move), uint16(entry.Weight), uint32(entry.Learn)})
+		}
+	}
+	sort.SliceStable(book, func(i, j int) bool { return book[i].key < book[j].key })
+	var data []byte
+	for _, entry := range book {
+		data = binary.BigEndian.AppendUint64(data, entry.key)
+		data = binary.BigEndian.AppendUint16(data, entry.move)
+		data = binary.BigEndian.AppendUint16(data, entry.weight)
+		data = binary.BigEndian.AppendUint32(data, entry.learn)
+	}
+	var path = filepath.Join(t.TempDir(), "book.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBook(t *testing.T) {
+	const castleFen = "r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R w KQkq - 0 1"
+	var path = writeBook(t, map[string][]BookEntry{
+		InitialPositionFen: {{ParseMove("e2e4"), 30, 0}, {ParseMove("d2d4"), 20, 7},
+			{ParseMove("e2e5"), 100, 0}, {ParseMove("g1f3"), 1, 0}},
+		castleFen: {{ParseMove("e1h1"), 1, 0}, {ParseMove("e1a1"), 1, 0}},
+	})
+	var book, err = OpenBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Len() != 6 {
+		t.Errorf("entries %v, want 6", book.Len())
+	}
+
+	var p = NewPositionFromFEN(InitialPositionFen)
+	var entries = book.Entries(p)
+	if len(entries) != 3 || entries[0].Move.String() != "e2e4" || entries[1].Learn != 7 {
+		t.Errorf("wrong entries %v", entries)
+	}
+	var castles = book.Entries(NewPositionFromFEN(castleFen))
+	if len(castles) != 2 || castles[0].Move.String() != "e1g1" || castles[1].Move.String() != "e1c1" {
+		t.Errorf("wrong castling entries %v", castles)
+	}
+
+	var r = rand.New(rand.NewSource(1))
+	var counts = make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		if move := book.PickMove(p, 0, r); move.String() != "e2e4" {
+			t.Fatalf("variety 0 picked %v", move)
+		}
+		counts[book.PickMove(p, 50, r).String()]++
+	}
+	if counts["e2e4"] < 500 || counts["d2d4"] < 300 || counts["g1f3"] != 0 {
+		t.Errorf("variety 50 picks %v", counts)
+	}
+
+	var e = NewEngine()
+	e.Threads.Value = 1
+	e.OwnBook.Value = true
+	e.BookFile.Value = path
+	var result = e.Search(SearchParams{Positions: []*Position{p}, Limits: LimitsType{Depth: 20}})
+	if len(result.MainLine) != 1 || result.Nodes != 0 ||
+		(result.MainLine[0].String() != "e2e4" && result.MainLine[0].String() != "d2d4") {
+		t.Errorf("no book move %v", result.MainLine)
+	}
+	result = e.Search(SearchParams{Positions: []*Position{p},
+		Limits: LimitsType{Depth: 2, SearchMoves: []Move{ParseMove("b1c3")}}})
+	if len(result.MainLine) == 0 || result.MainLine[0].String() != "b1c3" || result.Nodes == 0 {
+		t.Errorf("book move outside searchmoves %v", result.MainLine)
+	}
+
+	e.BookFile.Value = filepath.Join(t.TempDir(), "missing.bin")
+	e.Prepare()
+	if info := e.BookInfo(); !strings.HasPrefix(info, "Book not loaded") {
+		t.Errorf("missing book: %v", info)
+	}
+	if err := os.WriteFile(e.BookFile.Value, make([]byte, 17), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBook(e.BookFile.Value); !errors.Is(err, errWrongBookFile) {
+		t.Errorf("wrong book size: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"fmt"
+	"io"
 	"math"
 )
 
@@ -392,14 +393,15 @@ func (e *evaluation) Evaluate(p *Position) int {
 	return score
 }
 
-func (e *evaluation) Trace() {
-	PrintVector("bishopMobility", e.bishopMobility)
-	PrintVector("rookMobility", e.rookMobility)
-	PrintPst("knightPst", e.knightPst)
-	PrintPst("queenPst", e.queenPst)
-	PrintPst("kingOpeningPst", e.kingOpeningPst)
-	PrintPst("kingEndgamePst", e.kingEndgamePst)
-	PrintSlice2D("kingSafety", e.kingSafety)
+// Trace writes the evaluation tables to w.
+func (e *evaluation) Trace(w io.Writer) {
+	PrintVector(w, "bishopMobility", e.bishopMobility)
+	PrintVector(w, "rookMobility", e.rookMobility)
+	PrintPst(w, "knightPst", e.knightPst)
+	PrintPst(w, "queenPst", e.queenPst)
+	PrintPst(w, "kingOpeningPst", e.kingOpeningPst)
+	PrintPst(w, "kingEndgamePst", e.kingEndgamePst)
+	PrintSlice2D(w, "kingSafety", e.kingSafety)
 }
 
 func scaleSlice(source []int, minValue, maxValue int) []int {
@@ -517,27 +519,27 @@ func InterpolateSquare(arg, argFrom, argTo, valFrom, valTo float64) float64 {
 	return A*x*x + B*x + C
 }
 
-func PrintPst(name string, source []int) {
-	fmt.Println(name)
+func PrintPst(w io.Writer, name string, source []int) {
+	fmt.Fprintln(w, name)
 	for i := 0; i < 64; i++ {
 		var sq = FlipSquare(i)
-		fmt.Printf("%3v", source[sq])
+		fmt.Fprintf(w, "%3v", source[sq])
 		if File(sq) == FileH {
-			fmt.Println()
+			fmt.Fprintln(w)
 		} else {
-			fmt.Print(" ")
+			fmt.Fprint(w, " ")
 		}
 	}
 }
 
-func PrintVector(name string, source []int) {
-	fmt.Printf("%v %v\n", name, source)
+func PrintVector(w io.Writer, name string, source []int) {
+	fmt.Fprintf(w, "%v %v\n", name, source)
 }
 
-func PrintSlice2D(name string, source [][]int) {
-	fmt.Println(name)
+func PrintSlice2D(w io.Writer, name string, source [][]int) {
+	fmt.Fprintln(w, name)
 	for _, x := range source {
-		fmt.Println(x)
+		fmt.Fprintln(w, x)
 	}
 }
 
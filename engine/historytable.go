@@ -2,19 +2,60 @@ package engine
 
 import "sync/atomic"
 
-type historyTable []historyEntry
+const (
+	historyIndexSize = 1 << 10
+	historyMax       = 1 << 10
+)
+
+type historyTable struct {
+	history         []historyEntry
+	counterMoves    []Move
+	counterHistory  []int32
+	followupHistory []int32
+}
 
 type historyEntry struct {
 	success, try int32
 }
 
 func NewHistoryTable() historyTable {
-	return make([]historyEntry, 1<<10)
+	var ht = historyTable{
+		history:         make([]historyEntry, historyIndexSize),
+		counterMoves:    make([]Move, historyIndexSize),
+		counterHistory:  make([]int32, historyIndexSize*historyIndexSize),
+		followupHistory: make([]int32, historyIndexSize*historyIndexSize),
+	}
+	ht.Clear()
+	return ht
 }
 
 func (ht historyTable) Clear() {
-	for i := range ht {
-		ht[i] = historyEntry{1, 1}
+	for i := range ht.history {
+		ht.history[i] = historyEntry{1, 1}
+	}
+	for i := range ht.counterMoves {
+		ht.counterMoves[i] = MoveEmpty
+	}
+	for i := range ht.counterHistory {
+		ht.counterHistory[i] = 0
+	}
+	for i := range ht.followupHistory {
+		ht.followupHistory[i] = 0
+	}
+}
+
+// Age keeps history between searches of one game, but with less weight.
+func (ht historyTable) Age() {
+	for i := range ht.history {
+		var entry = &ht.history[i]
+		entry.success = (entry.success + 1) / 2
+		entry.try = (entry.try + 1) / 2
+	}
+	for i := range ht.counterHistory {
+		ht.counterHistory[i] /= 2
+	}
+	for i := range ht.followupHistory {
+		ht.followupHistory[i] /= 2
 	}
 }
 
@@ -25,14 +66,62 @@ func (ht historyTable) Update(ctx *searchContext, bestMove Move, depth int) {
 	}
 	var side = ctx.Position.WhiteMove
 	for _, move := range ctx.QuietsSearched {
-		atomic.AddInt32(&ht[pieceSquareIndex(side, move)].try, int32(depth))
+		atomic.AddInt32(&ht.history[pieceSquareIndex(side, move)].try, int32(depth))
+	}
+	atomic.AddInt32(&ht.history[pieceSquareIndex(side, bestMove)].success, int32(depth))
+
+	var prevMove1, prevMove2 = ctx.PrevMoves()
+	if prevMove1 != MoveEmpty {
+		var index = pieceSquareIndex(!side, prevMove1)
+		atomic.StoreInt32((*int32)(&ht.counterMoves[index]), int32(bestMove))
+	}
+	var bonus = min(depth*depth, historyMax/4)
+	for _, move := range ctx.QuietsSearched {
+		var delta = -bonus
+		if move == bestMove {
+			delta = bonus
+		}
+		if prevMove1 != MoveEmpty {
+			updateContinuation(ht.counterHistory, continuationIndex(!side, prevMove1, side, move), delta)
+		}
+		if prevMove2 != MoveEmpty {
+			updateContinuation(ht.followupHistory, continuationIndex(side, prevMove2, side, move), delta)
+		}
 	}
-	atomic.AddInt32(&ht[pieceSquareIndex(side, bestMove)].success, int32(depth))
 }
 
 func (ht historyTable) Score(side bool, move Move) int {
-	var entry = ht[pieceSquareIndex(side, move)]
-	return int((entry.success << 10) / entry.try)
+	var entry = &ht.history[pieceSquareIndex(side, move)]
+	return int((atomic.LoadInt32(&entry.success) << 10) / atomic.LoadInt32(&entry.try))
+}
+
+// ContinuationScore rates a quiet move by the moves of the previous two plies.
+func (ht historyTable) ContinuationScore(side bool, prevMove1, prevMove2, move Move) int {
+	var result = 0
+	if prevMove1 != MoveEmpty {
+		result += int(atomic.LoadInt32(&ht.counterHistory[continuationIndex(!side, prevMove1, side, move)]))
+	}
+	if prevMove2 != MoveEmpty {
+		result += int(atomic.LoadInt32(&ht.followupHistory[continuationIndex(side, prevMove2, side, move)]))
+	}
+	return result
+}
+
+func (ht historyTable) CounterMove(side bool, prevMove Move) Move {
+	if prevMove == MoveEmpty {
+		return MoveEmpty
+	}
+	return Move(atomic.LoadInt32((*int32)(&ht.counterMoves[pieceSquareIndex(!side, prevMove)])))
+}
+
+func updateContinuation(table []int32, index, bonus int) {
+	var value = int(atomic.LoadInt32(&table[index]))
+	value += bonus - value*AbsDelta(bonus, 0)/historyMax
+	atomic.StoreInt32(&table[index], int32(value))
+}
+
+func continuationIndex(prevSide bool, prevMove Move, side bool, move Move) int {
+	return pieceSquareIndex(prevSide, prevMove)*historyIndexSize + pieceSquareIndex(side, move)
 }
 
 func pieceSquareIndex(side bool, move Move) int {
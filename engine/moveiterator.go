@@ -1,14 +1,23 @@
 package engine
 
 const (
-	StageImportant = iota
-	StageRemaining
+	StageHash = iota
+	StageGoodCaptures
+	StageKillers
+	StageQuiets
+	StageBadCaptures
+	StageQCaptures
+	StageQChecks
+	StageDone
 )
 
 type moveIterator struct {
 	buffer      [MAX_MOVES]Move
 	important   []moveWithScore
 	remaining   []moveWithScore
+	badCaptures []moveWithScore
+	hashMove    Move
+	killers     [3]Move
 	stage, head int
 }
 
@@ -24,7 +33,7 @@ func (ctx *searchContext) InitQMoves(genChecks bool) {
 	}
 	ctx.mi.important = ctx.mi.important[:0]
 	ctx.mi.remaining = ctx.mi.remaining[:0]
-	ctx.mi.stage = StageImportant
+	ctx.mi.stage = StageQCaptures
 	ctx.mi.head = 0
 	for _, m := range GenerateCaptures(ctx.Position, genChecks, ctx.mi.buffer[:]) {
 		if IsCaptureOrPromotion(m) {
@@ -36,54 +45,136 @@ func (ctx *searchContext) InitQMoves(genChecks bool) {
 	sortMoves(ctx.mi.important)
 }
 
+// InitMoves prepares staged move generation: the hash move is tried before
+// any moves are generated, quiet moves are generated only if captures and
+// killers did not produce a cutoff.
 func (ctx *searchContext) InitMoves(hashMove Move) {
-	ctx.mi.important = ctx.mi.important[:0]
-	ctx.mi.remaining = ctx.mi.remaining[:0]
-	ctx.mi.stage = StageImportant
-	ctx.mi.head = 0
-	for _, m := range GenerateMoves(ctx.Position, ctx.mi.buffer[:]) {
-		if m == hashMove {
-			ctx.mi.important = append(ctx.mi.important, moveWithScore{m, 30000})
-		} else if IsCaptureOrPromotion(m) {
-			ctx.mi.important = append(ctx.mi.important, moveWithScore{m, 29000 + MVVLVA(m)})
-		} else if m == ctx.Killer1 {
-			ctx.mi.important = append(ctx.mi.important, moveWithScore{m, 28000})
-		} else if m == ctx.Killer2 {
-			ctx.mi.important = append(ctx.mi.important, moveWithScore{m, 28000 - 1})
-		} else {
-			ctx.mi.remaining = append(ctx.mi.remaining, moveWithScore{m, 0})
-		}
-	}
-	sortMoves(ctx.mi.important)
+	var prevMove1, _ = ctx.PrevMoves()
+	var mi = &ctx.mi
+	mi.hashMove = hashMove
+	mi.killers = [...]Move{ctx.Killer1, ctx.Killer2,
+		ctx.Engine.historyTable.CounterMove(ctx.Position.WhiteMove, prevMove1)}
+	mi.important = mi.important[:0]
+	mi.remaining = mi.remaining[:0]
+	mi.badCaptures = mi.badCaptures[:0]
+	mi.stage = StageHash
+	mi.head = 0
 }
 
 func (ctx *searchContext) NextMove() Move {
+	var mi = &ctx.mi
+	var p = ctx.Position
 	for {
-		switch ctx.mi.stage {
-		case StageImportant:
-			if ctx.mi.head < len(ctx.mi.important) {
-				var m = ctx.mi.important[ctx.mi.head].Move
-				ctx.mi.head++
+		switch mi.stage {
+		case StageHash:
+			if mi.head == 0 {
+				mi.head++
+				if mi.hashMove != MoveEmpty && p.IsPseudoLegal(mi.hashMove) {
+					return mi.hashMove
+				}
+			}
+			mi.nextStage()
+			for _, m := range GenerateCaptures(p, false, mi.buffer[:]) {
+				if m != mi.hashMove {
+					mi.important = append(mi.important, moveWithScore{m, MVVLVA(m)})
+				}
+			}
+			sortMoves(mi.important)
+		case StageGoodCaptures:
+			for mi.head < len(mi.important) {
+				var item = mi.important[mi.head]
+				mi.head++
+				if !SEE_GE(p, item.Move) {
+					mi.badCaptures = append(mi.badCaptures, item)
+					continue
+				}
+				return item.Move
+			}
+			mi.nextStage()
+		case StageKillers:
+			for mi.head < len(mi.killers) {
+				var m = mi.killers[mi.head]
+				mi.head++
+				if m != MoveEmpty && m != mi.hashMove && !mi.isKiller(m, mi.head-1) &&
+					!isNoisy(m) && p.IsPseudoLegal(m) {
+					return m
+				}
+			}
+			mi.nextStage()
+			for _, m := range GenerateMoves(p, mi.buffer[:]) {
+				if !isNoisy(m) && m != mi.hashMove && !mi.isKiller(m, len(mi.killers)) {
+					mi.remaining = append(mi.remaining, moveWithScore{m, ctx.HistoryScore(m)})
+				}
+			}
+			sortMoves(mi.remaining)
+		case StageQuiets:
+			if mi.head < len(mi.remaining) {
+				var m = mi.remaining[mi.head].Move
+				mi.head++
+				return m
+			}
+			mi.nextStage()
+		case StageBadCaptures:
+			if mi.head < len(mi.badCaptures) {
+				var m = mi.badCaptures[mi.head].Move
+				mi.head++
+				return m
+			}
+			return MoveEmpty
+		case StageQCaptures:
+			if mi.head < len(mi.important) {
+				var m = mi.important[mi.head].Move
+				mi.head++
 				return m
 			}
-			ctx.mi.head = 0
-			ctx.mi.stage++
-			for i := range ctx.mi.remaining {
-				var item = &ctx.mi.remaining[i]
-				item.Score = ctx.Engine.historyTable.Score(ctx.Position.WhiteMove, item.Move)
+			mi.nextStage()
+			for i := range mi.remaining {
+				var item = &mi.remaining[i]
+				item.Score = ctx.HistoryScore(item.Move)
 			}
-			sortMoves(ctx.mi.remaining)
-		case StageRemaining:
-			if ctx.mi.head < len(ctx.mi.remaining) {
-				var m = ctx.mi.remaining[ctx.mi.head].Move
-				ctx.mi.head++
+			sortMoves(mi.remaining)
+		case StageQChecks:
+			if mi.head < len(mi.remaining) {
+				var m = mi.remaining[mi.head].Move
+				mi.head++
 				return m
 			}
 			return MoveEmpty
+		default:
+			return MoveEmpty
 		}
 	}
 }
 
+func (mi *moveIterator) nextStage() {
+	mi.stage++
+	mi.head = 0
+}
+
+// isKiller reports whether move is among the first count killers.
+func (mi *moveIterator) isKiller(move Move, count int) bool {
+	for i := 0; i < count; i++ {
+		if mi.killers[i] == move {
+			return true
+		}
+	}
+	return false
+}
+
+// isNoisy reports whether move is generated by GenerateCaptures without checks:
+// captures and queen promotions. Underpromotions are searched with quiet moves.
+func isNoisy(move Move) bool {
+	return IsCaptureOrPromotion(move) &&
+		(move.Promotion() == Empty || move.Promotion() == Queen)
+}
+
+func (ctx *searchContext) HistoryScore(move Move) int {
+	var side = ctx.Position.WhiteMove
+	var prevMove1, prevMove2 = ctx.PrevMoves()
+	var ht = &ctx.Engine.historyTable
+	return ht.Score(side, move) + ht.ContinuationScore(side, prevMove1, prevMove2, move)
+}
+
 func MVVLVA(move Move) int {
 	var captureScore = pieceValuesSEE[move.CapturedPiece()]
 	if move.Promotion() != Empty {
@@ -459,3 +459,104 @@ func GenerateLegalMoves(p *Position) []Move {
 	}
 	return result[:legalMoves]
 }
+
+// IsPseudoLegal reports whether move can be made in this position by MakeMove.
+// It is used to validate hash, killer and counter moves without generating all moves.
+func (p *Position) IsPseudoLegal(move Move) bool {
+	if move == MoveEmpty {
+		return false
+	}
+	var from, to = move.From(), move.To()
+	var piece, captured, promotion = move.MovingPiece(), move.CapturedPiece(), move.Promotion()
+	var ownPieces, oppPieces = p.White, p.Black
+	if !p.WhiteMove {
+		ownPieces, oppPieces = p.Black, p.White
+	}
+	var allPieces = ownPieces | oppPieces
+
+	if (squareMask[from]&ownPieces) == 0 || p.WhatPiece(from) != piece {
+		return false
+	}
+
+	if piece == Pawn {
+		var lastRank = let(p.WhiteMove, Rank8, Rank1)
+		if (Rank(to) == lastRank) != (promotion != Empty) {
+			return false
+		}
+		if promotion != Empty && (promotion < Knight || promotion > Queen) {
+			return false
+		}
+		if to == p.EpSquare && p.EpSquare != SquareNone {
+			return captured == Pawn && (PawnAttacks(from, p.WhiteMove)&squareMask[to]) != 0
+		}
+	} else if promotion != Empty {
+		return false
+	}
+
+	if captured == Empty {
+		if (squareMask[to] & allPieces) != 0 {
+			return false
+		}
+	} else if captured == King || (squareMask[to]&oppPieces) == 0 ||
+		p.WhatPiece(to) != captured {
+		return false
+	}
+
+	switch piece {
+	case Pawn:
+		if captured != Empty {
+			return (PawnAttacks(from, p.WhiteMove) & squareMask[to]) != 0
+		}
+		if p.WhiteMove {
+			return to == from+8 ||
+				to == from+16 && Rank(from) == Rank2 && (squareMask[from+8]&allPieces) == 0
+		}
+		return to == from-8 ||
+			to == from-16 && Rank(from) == Rank7 && (squareMask[from-8]&allPieces) == 0
+	case Knight:
+		return (knightAttacks[from] & squareMask[to]) != 0
+	case Bishop:
+		return (BishopAttacks(from, allPieces) & squareMask[to]) != 0
+	case Rook:
+		return (RookAttacks(from, allPieces) & squareMask[to]) != 0
+	case Queen:
+		return (QueenAttacks(from, allPieces) & squareMask[to]) != 0
+	case King:
+		if (kingAttacks[from] & squareMask[to]) != 0 {
+			return true
+		}
+		return p.isPseudoLegalCastle(move, allPieces)
+	}
+	return false
+}
+
+func (p *Position) isPseudoLegalCastle(move Move, allPieces uint64) bool {
+	if p.WhiteMove {
+		if move == whiteKingSideCastle {
+			return (p.CastleRights&WhiteKingSide) != 0 &&
+				(allPieces&F1G1) == 0 &&
+				!p.isAttackedBySide(SquareE1, false) &&
+				!p.isAttackedBySide(SquareF1, false)
+		}
+		if move == whiteQueenSideCastle {
+			return (p.CastleRights&WhiteQueenSide) != 0 &&
+				(allPieces&B1D1) == 0 &&
+				!p.isAttackedBySide(SquareE1, false) &&
+				!p.isAttackedBySide(SquareD1, false)
+		}
+	} else {
+		if move == blackKingSideCastle {
+			return (p.CastleRights&BlackKingSide) != 0 &&
+				(allPieces&F8G8) == 0 &&
+				!p.isAttackedBySide(SquareE8, true) &&
+				!p.isAttackedBySide(SquareF8, true)
+		}
+		if move == blackQueenSideCastle {
+			return (p.CastleRights&BlackQueenSide) != 0 &&
+				(allPieces&B8D8) == 0 &&
+				!p.isAttackedBySide(SquareE8, true) &&
+				!p.isAttackedBySide(SquareD8, true)
+		}
+	}
+	return false
+}
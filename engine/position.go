@@ -20,9 +20,21 @@ func createPosition(board [64]int, wtm bool, castleRights, ep, fifty int) *Posit
 		}
 	}
 
+	if PopCount(p.Kings&p.White) != 1 || PopCount(p.Kings&p.Black) != 1 {
+		return nil
+	}
+	// A pawn cannot stand on its promotion rank. Pawns on their own first rank are
+	// allowed, some variants like Theban Chess start with them.
+	if (p.Pawns&p.White&Rank8Mask) != 0 || (p.Pawns&p.Black&Rank1Mask) != 0 {
+		return nil
+	}
+
 	p.WhiteMove = wtm
-	p.CastleRights = castleRights
+	p.CastleRights = castleRights & p.possibleCastleRights()
 	p.EpSquare = ep
+	if ep != SquareNone && !p.isPossibleEpSquare(ep) {
+		p.EpSquare = SquareNone
+	}
 	p.Rule50 = fifty
 	p.Key = p.ComputeKey()
 	p.Checkers = p.computeCheckers()
@@ -34,26 +46,80 @@ func createPosition(board [64]int, wtm bool, castleRights, ep, fifty int) *Posit
 	return p
 }
 
+// possibleCastleRights keeps castle rights only for kings and rooks on their initial squares.
+func (p *Position) possibleCastleRights() int {
+	var result = 0
+	var whiteRooks = p.Rooks & p.White
+	var blackRooks = p.Rooks & p.Black
+	if (p.Kings & p.White & squareMask[SquareE1]) != 0 {
+		if (whiteRooks & squareMask[SquareH1]) != 0 {
+			result |= WhiteKingSide
+		}
+		if (whiteRooks & squareMask[SquareA1]) != 0 {
+			result |= WhiteQueenSide
+		}
+	}
+	if (p.Kings & p.Black & squareMask[SquareE8]) != 0 {
+		if (blackRooks & squareMask[SquareH8]) != 0 {
+			result |= BlackKingSide
+		}
+		if (blackRooks & squareMask[SquareA8]) != 0 {
+			result |= BlackQueenSide
+		}
+	}
+	return result
+}
+
+// isPossibleEpSquare reports whether a pawn of the side not to move
+// could have just passed over ep.
+func (p *Position) isPossibleEpSquare(ep int) bool {
+	if p.WhiteMove {
+		return Rank(ep) == Rank6 && (p.Pawns&p.Black&squareMask[ep-8]) != 0
+	}
+	return Rank(ep) == Rank3 && (p.Pawns&p.White&squareMask[ep+8]) != 0
+}
+
+// NewPositionFromFEN returns nil if fen is not a valid position.
+// Castling, en passant and move counter fields may be omitted.
 func NewPositionFromFEN(fen string) *Position {
-	var tokens = s.Split(fen, " ")
+	var tokens = s.Fields(fen)
+	if len(tokens) < 2 {
+		return nil
+	}
 
 	var board [64]int
 
 	var i = 0
 	for _, ch := range tokens[0] {
-		if unicode.IsDigit(ch) {
-			var n, _ = strconv.Atoi(string(ch))
-			i += n
+		if ch >= '1' && ch <= '8' {
+			i += int(ch - '0')
 		} else if unicode.IsLetter(ch) {
 			var pt = ParsePiece(ch)
+			if pt == Empty || i >= 64 {
+				return nil
+			}
 			board[FlipSquare(i)] = pt
 			i++
+		} else if ch != '/' {
+			return nil
 		}
+		if i > 64 {
+			return nil
+		}
+	}
+	if i != 64 {
+		return nil
 	}
 
+	if tokens[1] != "w" && tokens[1] != "b" {
+		return nil
+	}
 	var whiteMove = tokens[1] == "w"
 
-	var sCastleRights = tokens[2]
+	var sCastleRights = "-"
+	if len(tokens) > 2 {
+		sCastleRights = tokens[2]
+	}
 	var cr = 0
 	if s.Contains(sCastleRights, "K") {
 		cr |= WhiteKingSide
@@ -68,7 +134,10 @@ func NewPositionFromFEN(fen string) *Position {
 		cr |= BlackQueenSide
 	}
 
-	var epSquare = ParseSquare(tokens[3])
+	var epSquare = SquareNone
+	if len(tokens) > 3 {
+		epSquare = ParseSquare(tokens[3])
+	}
 
 	var rule50 = 0
 	if len(tokens) > 4 {
@@ -1,14 +1,5 @@
 package engine
 
-import "sync"
-
-func RecoverFromSearchTimeout() {
-	var r = recover()
-	if r != nil && r != searchTimeout {
-		panic(r)
-	}
-}
-
 func (ctx *searchContext) GenRootMoves() []Move {
 	ctx.mi.important = ctx.mi.important[:0]
 	var child = ctx.Next()
@@ -26,107 +17,278 @@ func (ctx *searchContext) GenRootMoves() []Move {
 	return result
 }
 
-func (ctx *searchContext) IterateSearch(progress func(SearchInfo)) (result SearchInfo) {
-	defer RecoverFromSearchTimeout()
+func (ctx *searchContext) IterateSearch(limits LimitsType,
+	progress func(SearchInfo)) (result SearchInfo) {
 	var engine = ctx.Engine
 	defer func() {
 		result.Time = engine.timeManager.ElapsedMilliseconds()
 		result.Nodes = engine.timeManager.Nodes()
 	}()
 
-	var p = ctx.Position
 	var ml = ctx.GenRootMoves()
+	var restricted = false
+	if len(limits.SearchMoves) > 0 {
+		if filtered := filterRootMoves(ml, limits.SearchMoves); len(filtered) > 0 {
+			ml = filtered
+			restricted = true
+		}
+	}
+	ml, ctx.rootInTB = ctx.tbRootMoves(ml)
 	if len(ml) == 0 {
 		return
 	}
 	result.MainLine = []Move{ml[0]}
-	if len(ml) == 1 {
+	if len(ml) == 1 && !restricted {
 		return
 	}
 
-	const height = 0
-	const beta = VALUE_INFINITE
-	var gate sync.Mutex
-	for depth := 2; depth <= MAX_HEIGHT; depth++ {
+	var multiPV = min(engine.multiPV(), len(ml))
+	var maxDepth = MAX_HEIGHT
+	if limits.Depth > 0 {
+		maxDepth = min(limits.Depth, MAX_HEIGHT)
+	}
+	var isMainThread = ctx.Thread == 0
+	for depth := min(2, maxDepth); depth <= maxDepth; depth++ {
+		if skipDepth(ctx.Thread, depth) {
+			continue
+		}
 		var prevScore = result.Score
-		var alpha = -VALUE_INFINITE
-		var bestMoveIndex = 0
-		{
-			var child = ctx.Next()
-			var move = ml[0]
-			p.MakeMove(move, child.Position)
-			var newDepth = ctx.NewDepth(depth, child)
-			var score = -child.AlphaBeta(-beta, -alpha, newDepth)
-			alpha = score
-			result = SearchInfo{
-				Depth:    depth,
-				Score:    score,
-				MainLine: append([]Move{move}, child.PrincipalVariation...),
-				Time:     engine.timeManager.ElapsedMilliseconds(),
-				Nodes:    engine.timeManager.Nodes(),
-			}
-			if progress != nil {
-				progress(result)
+		var alpha, beta = -VALUE_INFINITE, VALUE_INFINITE
+		var delta = AspirationWindow
+		if depth >= AspirationMinDepth && multiPV == 1 &&
+			AbsDelta(prevScore, 0) < VALUE_MATE_IN_MAX_HEIGHT {
+			alpha = max(prevScore-delta, -VALUE_INFINITE)
+			beta = min(prevScore+delta, VALUE_INFINITE)
+		}
+		var lines []SearchLine
+		var info SearchInfo
+		ctx.SelDepth = 0
+		var onMove func(move Move, number int)
+		if isMainThread && progress != nil {
+			onMove = func(move Move, number int) {
+				var elapsed = engine.timeManager.ElapsedMilliseconds()
+				if elapsed >= CurrMoveMinTime {
+					progress(SearchInfo{
+						Depth:          depth,
+						CurrMove:       move,
+						CurrMoveNumber: number,
+						Time:           elapsed,
+						Nodes:          engine.timeManager.Nodes(),
+					})
+				}
 			}
 		}
-		var index = 1
-		ParallelDo(engine.Threads.Value, func(threadIndex int) {
-			defer RecoverFromSearchTimeout()
-			var child = ctx.NextOnThread(threadIndex)
-			for {
-				gate.Lock()
-				var localAlpha = alpha
-				var localIndex = index
-				index++
-				gate.Unlock()
-				if localIndex >= len(ml) {
-					return
+		for {
+			lines = ctx.SearchRoot(ml, depth, alpha, beta, multiPV, func(lines []SearchLine) {
+				info = SearchInfo{
+					Depth:    depth,
+					SelDepth: ctx.SelDepth,
+					Score:    lines[0].Score,
+					MainLine: lines[0].MainLine,
+					Lines:    append([]SearchLine(nil), lines...),
+					Time:     engine.timeManager.ElapsedMilliseconds(),
+					Nodes:    engine.timeManager.Nodes(),
 				}
-				var move = ml[localIndex]
-				p.MakeMove(move, child.Position)
-				var newDepth = ctx.NewDepth(depth, child)
-				var score = -child.AlphaBeta(-beta, -localAlpha, newDepth)
-				if score <= localAlpha {
-					continue
+				if lines[0].Score >= beta {
+					info.Bound = Lower
+				}
+				if isMainThread && progress != nil {
+					progress(info)
 				}
-				gate.Lock()
-				if score > alpha {
-					alpha = score
-					result = SearchInfo{
+			}, onMove)
+			if engine.timeManager.IsStopped() {
+				// the iteration is incomplete, keep the result of the previous one
+				return
+			}
+			if len(lines) == 0 {
+				// fail low: keep the best move of the previous iteration
+				if isMainThread && progress != nil {
+					progress(SearchInfo{
 						Depth:    depth,
-						Score:    score,
-						MainLine: append([]Move{move}, child.PrincipalVariation...),
+						SelDepth: ctx.SelDepth,
+						Score:    alpha,
+						Bound:    Upper,
+						MainLine: result.MainLine,
 						Time:     engine.timeManager.ElapsedMilliseconds(),
 						Nodes:    engine.timeManager.Nodes(),
-					}
-					if progress != nil {
-						progress(result)
-					}
-					bestMoveIndex = localIndex
+					})
 				}
-				gate.Unlock()
+				alpha = max(alpha-delta, -VALUE_INFINITE)
+			} else if lines[0].Score >= beta {
+				beta = min(beta+delta, VALUE_INFINITE)
+			} else {
+				break
 			}
-		})
+			delta *= 2
+			if delta >= AspirationMaxWindow {
+				alpha, beta = -VALUE_INFINITE, VALUE_INFINITE
+			}
+		}
+		result = info
+		if ctx.Stats != nil {
+			ctx.Stats.addIteration(depth)
+		}
 		if engine.timeManager.IsHardTimeout() {
 			break
 		}
-		if alpha >= MateIn(depth) || alpha <= MatedIn(depth) {
-			break
+		if isMainThread {
+			if limits.Mate > 0 {
+				if result.Score >= MateIn(2*limits.Mate-1) {
+					break
+				}
+			} else if result.Score >= MateIn(depth) || result.Score <= MatedIn(depth) {
+				break
+			}
+			if AbsDelta(prevScore, result.Score) <= PawnValue/2 && engine.timeManager.IsSoftTimeout() {
+				break
+			}
 		}
-		if AbsDelta(prevScore, alpha) <= PawnValue/2 && engine.timeManager.IsSoftTimeout() {
-			break
+		for i := len(lines) - 1; i >= 0; i-- {
+			MoveToBegin(ml, findMoveIndex(ml, lines[i].MainLine[0]))
 		}
-		MoveToBegin(ml, bestMoveIndex)
 		HashStorePV(ctx, result.Depth, result.Score, result.MainLine)
 	}
 	return
 }
 
+const (
+	AspirationMinDepth  = 5
+	AspirationWindow    = PawnValue / 4
+	AspirationMaxWindow = 4 * PawnValue
+)
+
+// CurrMoveMinTime is the search time in milliseconds after which
+// the main thread reports the root move being searched.
+const CurrMoveMinTime = 3000
+
+const (
+	SEEPruningDepth  = 4
+	SEEQuietMargin   = PawnValue
+	SEECaptureMargin = PawnValue / 2
+)
+
+// SearchRoot searches root moves with principal variation search and returns
+// the best lines sorted by score. Lines are empty if all moves fail low.
+// onLine is called each time the set of best lines changes,
+// onMove before each root move is searched.
+func (ctx *searchContext) SearchRoot(ml []Move, depth, alpha, beta, multiPV int,
+	onLine func(lines []SearchLine), onMove func(move Move, number int)) []SearchLine {
+	var p = ctx.Position
+	var child = ctx.Next()
+	var lines = make([]SearchLine, 0, multiPV)
+	for i, move := range ml {
+		if onMove != nil {
+			onMove(move, i+1)
+		}
+		p.MakeMove(move, child.Position)
+		var newDepth = ctx.NewDepth(depth, child)
+		var score int
+		if len(lines) == multiPV {
+			score = -child.AlphaBeta(-(alpha + 1), -alpha, newDepth)
+			if ctx.Engine.timeManager.IsStopped() {
+				break
+			}
+			if score <= alpha {
+				continue
+			}
+		}
+		score = -child.AlphaBeta(-beta, -alpha, newDepth)
+		if ctx.Engine.timeManager.IsStopped() {
+			break
+		}
+		if score <= alpha {
+			continue
+		}
+		lines = insertLine(lines, multiPV, SearchLine{
+			Score:    score,
+			MainLine: append([]Move{move}, child.PrincipalVariation...),
+		})
+		if len(lines) == multiPV {
+			alpha = lines[multiPV-1].Score
+		}
+		onLine(lines)
+		if score >= beta {
+			break
+		}
+	}
+	return lines
+}
+
+// Helper threads of the lazy SMP search skip some iterations,
+// so that threads spread over different depths.
+var (
+	skipSize  = [...]int{1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 4, 4, 4}
+	skipPhase = [...]int{0, 1, 0, 1, 2, 3, 0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 5, 6, 7}
+)
+
+func skipDepth(thread, depth int) bool {
+	if thread == 0 {
+		return false
+	}
+	var i = (thread - 1) % len(skipSize)
+	return ((depth+skipPhase[i])/skipSize[i])%2 != 0
+}
+
+// selectBestResult prefers a helper thread result only if it is both deeper
+// and better than the result of the main thread.
+func selectBestResult(results []SearchInfo) SearchInfo {
+	var best = results[0]
+	for _, result := range results[1:] {
+		if len(result.MainLine) > 0 &&
+			result.Depth > best.Depth && result.Score > best.Score {
+			best = result
+		}
+	}
+	return best
+}
+
+// filterRootMoves keeps the root moves listed in searchMoves.
+// Moves from searchMoves are matched by squares and promotion only.
+func filterRootMoves(ml, searchMoves []Move) []Move {
+	var result []Move
+	for _, m := range ml {
+		for _, sm := range searchMoves {
+			if m.From() == sm.From() && m.To() == sm.To() &&
+				m.Promotion() == sm.Promotion() {
+				result = append(result, m)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// insertLine keeps lines sorted by score and no longer than multiPV.
+func insertLine(lines []SearchLine, multiPV int, line SearchLine) []SearchLine {
+	var i = len(lines)
+	for i > 0 && lines[i-1].Score < line.Score {
+		i--
+	}
+	if i >= multiPV {
+		return lines
+	}
+	if len(lines) < multiPV {
+		lines = append(lines, SearchLine{})
+	}
+	copy(lines[i+1:], lines[i:])
+	lines[i] = line
+	return lines
+}
+
+func findMoveIndex(ml []Move, move Move) int {
+	for i := range ml {
+		if ml[i] == move {
+			return i
+		}
+	}
+	return -1
+}
+
 func HashStorePV(ctx *searchContext, depth, score int, pv []Move) {
 	for _, move := range pv {
-		if _, _, _, _, ok := ctx.Engine.transTable.Read(ctx.Position); !ok {
+		if _, _, _, _, _, ok := ctx.Engine.transTable.Read(ctx.Position); !ok {
 			ctx.Engine.transTable.Update(ctx.Position, depth,
-				ValueToTT(score, ctx.Height), Lower|Upper, move)
+				ValueToTT(score, ctx.Height), VALUE_INFINITE, Lower|Upper, move)
 		}
 		var child = ctx.Next()
 		ctx.Position.MakeMove(move, child.Position)
@@ -143,7 +305,7 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 	ctx.ClearPV()
 
 	if ctx.Height >= MAX_HEIGHT || ctx.IsDraw() {
-		return VALUE_DRAW
+		return ctx.DrawValue()
 	}
 
 	if depth <= 0 {
@@ -151,7 +313,14 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 	}
 
 	var engine = ctx.Engine
-	engine.timeManager.IncNodes()
+	if engine.timeManager.IncNodes(ctx.counter) {
+		return 0
+	}
+	var stats = ctx.Stats
+	if stats != nil {
+		stats.Nodes++
+	}
+	ctx.updateSelDepth()
 
 	beta = min(beta, MateIn(ctx.Height+1))
 	if alpha >= beta {
@@ -160,27 +329,73 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 
 	var position = ctx.Position
 	var hashMove = MoveEmpty
-
-	if ttDepth, ttScore, ttType, ttMove, ok := engine.transTable.Read(position); ok {
+	var isPV = beta-alpha > 1
+	var excludedMove = ctx.ExcludedMove
+
+	var ttDepth, ttScore, ttEval, ttType, ttMove, ttHit = engine.transTable.Read(position)
+	ttEval = engine.cachedEval(ttEval)
+	if stats != nil {
+		stats.TTProbes++
+		if ttHit {
+			stats.TTHits++
+		}
+	}
+	if ttHit && excludedMove == MoveEmpty {
 		hashMove = ttMove
-		if ttDepth >= depth {
-			ttScore = ValueFromTT(ttScore, ctx.Height)
+		ttScore = ValueFromTT(ttScore, ctx.Height)
+		if ttDepth >= depth && !isPV {
 			if ttScore >= beta && (ttType&Lower) != 0 {
+				if stats != nil {
+					stats.TTCutoffs++
+				}
 				return beta
 			}
 			if ttScore <= alpha && (ttType&Upper) != 0 {
+				if stats != nil {
+					stats.TTCutoffs++
+				}
 				return alpha
 			}
 		}
 	}
 
+	if excludedMove == MoveEmpty {
+		if egtbScore, ok := ctx.probeEndgameTables(); ok {
+			engine.transTable.Update(position, min(depth+6, MAX_HEIGHT-1),
+				ValueToTT(egtbScore, ctx.Height), VALUE_INFINITE, Lower|Upper, MoveEmpty)
+			return max(alpha, min(beta, egtbScore))
+		}
+		if tbScore, tbBound, ok := ctx.probeTablebases(depth); ok {
+			if tbBound == Lower|Upper ||
+				(tbBound == Lower && tbScore >= beta) ||
+				(tbBound == Upper && tbScore <= alpha) {
+				engine.transTable.Update(position, min(depth+6, MAX_HEIGHT-1),
+					ValueToTT(tbScore, ctx.Height), VALUE_INFINITE, tbBound, MoveEmpty)
+				return max(alpha, min(beta, tbScore))
+			}
+			// The search can only find a faster mate. Non-PV nodes keep
+			// their window, narrowing it would change a fail-hard result.
+			if isPV {
+				if tbBound == Lower {
+					alpha = max(alpha, tbScore)
+				} else {
+					beta = min(beta, tbScore)
+				}
+			}
+		}
+	}
+
 	var isCheck = position.IsCheck()
 
 	var child = ctx.Next()
-	if depth >= 2 && !isCheck && position.LastMove != MoveEmpty &&
+	if depth >= 2 && !isPV && !isCheck && position.LastMove != MoveEmpty &&
+		excludedMove == MoveEmpty &&
 		beta < VALUE_MATE_IN_MAX_HEIGHT &&
 		!IsLateEndgame(position, position.WhiteMove) {
 		newDepth = depth - 4
+		if stats != nil {
+			stats.NullMoveTries++
+		}
 		position.MakeNullMove(child.Position)
 		if newDepth <= 0 {
 			score = -child.Quiescence(-beta, -(beta - 1), 1)
@@ -188,35 +403,73 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 			score = -child.AlphaBeta(-beta, -(beta - 1), newDepth)
 		}
 		if score >= beta {
+			if stats != nil {
+				stats.NullMoveCutoffs++
+			}
 			return beta
 		}
 	}
 
-	if depth >= 4 && hashMove == MoveEmpty {
+	if depth >= 4 && hashMove == MoveEmpty && excludedMove == MoveEmpty {
 		newDepth = depth - 2
 		ctx.AlphaBeta(alpha, beta, newDepth)
 		hashMove = ctx.BestMove()
 		ctx.ClearPV() //!
 	}
 
+	// Singular extension: if all moves except the hash move fail low
+	// against a reduced bound, the hash move is extended.
+	// If they fail high against beta too, several moves refute the node (multi-cut).
+	var singularMove = MoveEmpty
+	if engine.SingularDepth.Value > 0 && depth >= engine.SingularDepth.Value &&
+		excludedMove == MoveEmpty && hashMove != MoveEmpty && hashMove == ttMove &&
+		ttDepth >= depth-3 && (ttType&Lower) != 0 &&
+		AbsDelta(ttScore, 0) < VALUE_MATE_IN_MAX_HEIGHT {
+		var singularBeta = ttScore - engine.SingularMargin.Value*depth
+		ctx.ExcludedMove = hashMove
+		score = ctx.AlphaBeta(singularBeta-1, singularBeta, depth/2)
+		ctx.ExcludedMove = MoveEmpty
+		ctx.ClearPV()
+		if score < singularBeta {
+			singularMove = hashMove
+		} else if engine.MultiCut.Value && singularBeta >= beta {
+			return beta
+		}
+	}
+
 	ctx.InitMoves(hashMove)
 	var moveCount = 0
 	ctx.QuietsSearched = ctx.QuietsSearched[:0]
+	// static evaluation is computed lazily, VALUE_INFINITE means unknown
 	var staticEval = VALUE_INFINITE
+	if ttHit && !isCheck {
+		staticEval = ttEval
+	}
 
 	for {
+		if engine.timeManager.IsStopped() {
+			return 0
+		}
+
 		var move = ctx.NextMove()
 		if move == MoveEmpty {
 			break
 		}
 
+		if move == excludedMove {
+			continue
+		}
+
 		if position.MakeMove(move, child.Position) {
 			moveCount++
 
 			newDepth = ctx.NewDepth(depth, child)
+			if move == singularMove {
+				newDepth = depth
+			}
 			var reduction = 0
 
-			if ctx.mi.stage == StageRemaining && moveCount > 1 &&
+			if ctx.mi.stage == StageQuiets && moveCount > 1 &&
 				!isCheck && !child.Position.IsCheck() &&
 				!IsPawnPush7th(move, position.WhiteMove) &&
 				alpha > VALUE_MATED_IN_MAX_HEIGHT {
@@ -230,25 +483,58 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 					}
 				}
 
+				if depth <= SEEPruningDepth &&
+					!SEEThreshold(position, move, -SEEQuietMargin*depth) {
+					continue
+				}
+
 				if !IsPawnAdvance(move, position.WhiteMove) {
 					if moveCount > 9 {
 						reduction = 2
 					} else {
 						reduction = 1
 					}
-					reduction = min(depth-2, reduction)
+					var prevMove1, prevMove2 = ctx.PrevMoves()
+					var history = engine.historyTable.ContinuationScore(position.WhiteMove,
+						prevMove1, prevMove2, move)
+					if history < 0 {
+						reduction++
+					} else if history > historyMax/2 {
+						reduction--
+					}
+					reduction = max(0, min(depth-2, reduction))
 				}
 			}
 
+			if ctx.mi.stage == StageBadCaptures && moveCount > 1 &&
+				depth <= SEEPruningDepth && !isCheck && !child.Position.IsCheck() &&
+				alpha > VALUE_MATED_IN_MAX_HEIGHT &&
+				!SEEThreshold(position, move, -SEECaptureMargin*depth*depth) {
+				continue
+			}
+
 			if !IsCaptureOrPromotion(move) {
 				ctx.QuietsSearched = append(ctx.QuietsSearched, move)
 			}
 
 			if reduction > 0 {
+				if stats != nil {
+					stats.LMRSearches++
+				}
 				score = -child.AlphaBeta(-(alpha + 1), -alpha, depth-1-reduction)
 				if score <= alpha {
 					continue
 				}
+				if stats != nil {
+					stats.LMRResearches++
+				}
+			}
+
+			if isPV && moveCount > 1 {
+				score = -child.AlphaBeta(-(alpha + 1), -alpha, newDepth)
+				if score <= alpha {
+					continue
+				}
 			}
 
 			score = -child.AlphaBeta(-beta, -alpha, newDepth)
@@ -257,17 +543,30 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 				alpha = score
 				ctx.ComposePV(move, child)
 				if alpha >= beta {
+					if stats != nil {
+						stats.FailHighs++
+						if moveCount == 1 {
+							stats.FirstMoveFailHighs++
+						}
+					}
 					break
 				}
 			}
 		}
 	}
 
+	if engine.timeManager.IsStopped() {
+		return 0
+	}
+
 	if moveCount == 0 {
+		if excludedMove != MoveEmpty {
+			return alpha
+		}
 		if isCheck {
 			return MatedIn(ctx.Height)
 		}
-		return VALUE_DRAW
+		return ctx.DrawValue()
 	}
 
 	var bestMove = ctx.BestMove()
@@ -276,47 +575,79 @@ func (ctx *searchContext) AlphaBeta(alpha, beta, depth int) int {
 		engine.historyTable.Update(ctx, bestMove, depth)
 	}
 
-	var ttType = 0
+	if excludedMove != MoveEmpty {
+		return alpha
+	}
+
+	var bound = 0
 	if bestMove != MoveEmpty {
-		ttType |= Lower
+		bound |= Lower
 	}
 	if alpha < beta {
-		ttType |= Upper
+		bound |= Upper
 	}
-	engine.transTable.Update(position, depth, ValueToTT(alpha, ctx.Height), ttType, bestMove)
+	engine.transTable.Update(position, depth, ValueToTT(alpha, ctx.Height),
+		engine.cachedEval(staticEval), bound, bestMove)
 
 	return alpha
 }
 
 func (ctx *searchContext) Quiescence(alpha, beta, depth int) int {
 	var engine = ctx.Engine
-	engine.timeManager.IncNodes()
 	ctx.ClearPV()
+	if engine.timeManager.IncNodes(ctx.counter) {
+		return 0
+	}
+	if ctx.Stats != nil {
+		ctx.Stats.QNodes++
+	}
+	ctx.updateSelDepth()
 	if ctx.Height >= MAX_HEIGHT {
-		return VALUE_DRAW
+		return ctx.DrawValue()
 	}
 	var position = ctx.Position
+	var _, ttScore, ttEval, ttType, _, ttHit = engine.transTable.Read(position)
+	ttEval = engine.cachedEval(ttEval)
+	if ttHit {
+		ttScore = ValueFromTT(ttScore, ctx.Height)
+		if ttScore >= beta && (ttType&Lower) != 0 {
+			return beta
+		}
+		if ttScore <= alpha && (ttType&Upper) != 0 {
+			return alpha
+		}
+	}
 	var isCheck = position.IsCheck()
-	var eval = 0
+	var eval = VALUE_INFINITE
 	if !isCheck {
-		eval = engine.evaluator.Evaluate(position)
+		if ttHit && ttEval != VALUE_INFINITE {
+			eval = ttEval
+		} else {
+			eval = engine.evaluator.Evaluate(position)
+		}
 		if eval > alpha {
 			alpha = eval
 		}
 		if eval >= beta {
+			engine.transTable.Update(position, 0, ValueToTT(eval, ctx.Height),
+				engine.cachedEval(eval), Lower, MoveEmpty)
 			return alpha
 		}
 	}
+	var oldAlpha = alpha
 	ctx.InitQMoves(depth > 0)
 	var moveCount = 0
 	var child = ctx.Next()
 	for {
+		if engine.timeManager.IsStopped() {
+			return 0
+		}
 		var move = ctx.NextMove()
 		if move == MoveEmpty {
 			break
 		}
 		var danger = IsDangerCapture(position, move)
-		if !isCheck && !danger && !SEE_GE(position, move) {
+		if !isCheck && !danger && !SEEThreshold(position, move, 0) {
 			continue
 		}
 		if position.MakeMove(move, child.Position) {
@@ -335,9 +666,20 @@ func (ctx *searchContext) Quiescence(alpha, beta, depth int) int {
 			}
 		}
 	}
+	if engine.timeManager.IsStopped() {
+		return 0
+	}
 	if isCheck && moveCount == 0 {
 		return MatedIn(ctx.Height)
 	}
+	var bound = Upper
+	if alpha >= beta {
+		bound = Lower
+	} else if alpha > oldAlpha {
+		bound = Lower | Upper
+	}
+	engine.transTable.Update(position, 0, ValueToTT(alpha, ctx.Height),
+		engine.cachedEval(eval), bound, ctx.BestMove())
 	return alpha
 }
 
@@ -0,0 +1,75 @@
+package engine
+
+import "fmt"
+
+// SearchStats counts search events of one thread.
+// Counters are collected only if the Statistics option is on,
+// otherwise searchContext.Stats is nil.
+type SearchStats struct {
+	Nodes, QNodes                  int64
+	TTProbes, TTHits, TTCutoffs    int64
+	NullMoveTries, NullMoveCutoffs int64
+	LMRSearches, LMRResearches     int64
+	FailHighs, FirstMoveFailHighs  int64
+	Iterations                     []IterationStats
+}
+
+// IterationStats is the number of nodes spent by the thread to complete the depth.
+type IterationStats struct {
+	Depth int
+	Nodes int64
+}
+
+func (s *SearchStats) Add(other *SearchStats) {
+	s.Nodes += other.Nodes
+	s.QNodes += other.QNodes
+	s.TTProbes += other.TTProbes
+	s.TTHits += other.TTHits
+	s.TTCutoffs += other.TTCutoffs
+	s.NullMoveTries += other.NullMoveTries
+	s.NullMoveCutoffs += other.NullMoveCutoffs
+	s.LMRSearches += other.LMRSearches
+	s.LMRResearches += other.LMRResearches
+	s.FailHighs += other.FailHighs
+	s.FirstMoveFailHighs += other.FirstMoveFailHighs
+}
+
+func (s *SearchStats) addIteration(depth int) {
+	var total = s.Nodes + s.QNodes
+	s.Iterations = append(s.Iterations, IterationStats{depth, total})
+}
+
+// Lines formats the statistics as a human readable report.
+func (s *SearchStats) Lines() []string {
+	var result = []string{
+		fmt.Sprintf("nodes %v qnodes %v (%.1f%%)",
+			s.Nodes+s.QNodes, s.QNodes, percent(s.QNodes, s.Nodes+s.QNodes)),
+		fmt.Sprintf("tt probes %v hits %.1f%% cutoffs %.1f%%",
+			s.TTProbes, percent(s.TTHits, s.TTProbes), percent(s.TTCutoffs, s.TTProbes)),
+		fmt.Sprintf("null move tries %v cutoffs %.1f%%",
+			s.NullMoveTries, percent(s.NullMoveCutoffs, s.NullMoveTries)),
+		fmt.Sprintf("lmr searches %v re-searches %.1f%%",
+			s.LMRSearches, percent(s.LMRResearches, s.LMRSearches)),
+		fmt.Sprintf("fail highs %v first move %.1f%%",
+			s.FailHighs, percent(s.FirstMoveFailHighs, s.FailHighs)),
+	}
+	var prevNodes, prevIterationNodes int64
+	for _, it := range s.Iterations {
+		var iterationNodes = it.Nodes - prevNodes
+		var line = fmt.Sprintf("depth %v nodes %v", it.Depth, iterationNodes)
+		if prevIterationNodes > 0 {
+			line += fmt.Sprintf(" branching %.2f", float64(iterationNodes)/float64(prevIterationNodes))
+		}
+		result = append(result, line)
+		prevNodes = it.Nodes
+		prevIterationNodes = iterationNodes
+	}
+	return result
+}
+
+func percent(count, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(count) / float64(total)
+}
@@ -76,22 +76,71 @@ func ScoreToUci(v int) string {
 	}
 }
 
+func BoundToUci(bound int) string {
+	switch bound {
+	case Lower:
+		return " lowerbound"
+	case Upper:
+		return " upperbound"
+	}
+	return ""
+}
+
+// String formats si as an uci info line. A SearchInfo without main line is
+// either the root move being searched or a heartbeat with search statistics.
 func (si *SearchInfo) String() string {
+	if len(si.MainLine) == 0 {
+		if si.CurrMove != MoveEmpty {
+			return fmt.Sprintf("info depth %v currmove %v currmovenumber %v",
+				si.Depth, si.CurrMove, si.CurrMoveNumber)
+		}
+		return "info " + si.statsString()
+	}
+	return fmt.Sprintf("info depth %v seldepth %v score %v%v %v pv %v",
+		si.Depth, si.SelDepth, ScoreToUci(si.Score), BoundToUci(si.Bound),
+		si.statsString(), PVToUci(si.MainLine))
+}
+
+func (si *SearchInfo) statsString() string {
 	var nps = si.Nodes * 1000 / (si.Time + 1)
-	return fmt.Sprintf("info score %v depth %v nodes %v time %v nps %v pv %v",
-		ScoreToUci(si.Score), si.Depth, si.Nodes, si.Time, nps, PVToUci(si.MainLine))
+	return fmt.Sprintf("nodes %v time %v nps %v hashfull %v tbhits %v",
+		si.Nodes, si.Time, nps, si.HashFull, si.TBHits)
 }
 
-func SendProgressToUci(si SearchInfo) {
-	if si.Time >= 500 || si.Depth >= 5 {
-		fmt.Println(si.String())
+// MultiPVStrings returns one info line per searched line. For a single line
+// it is the same as String.
+func (si *SearchInfo) MultiPVStrings() []string {
+	if len(si.Lines) <= 1 {
+		return []string{si.String()}
 	}
+	var result = make([]string, len(si.Lines))
+	for i, line := range si.Lines {
+		result[i] = fmt.Sprintf("info depth %v seldepth %v multipv %v score %v %v pv %v",
+			si.Depth, si.SelDepth, i+1, ScoreToUci(line.Score),
+			si.statsString(), PVToUci(line.MainLine))
+	}
+	return result
+}
+
+// cachedEval returns eval if the transposition table may keep it. The table outlives
+// the search, so it keeps the static evaluation and the scores of endgame tables,
+// which depend only on the position, but not the noise of skill levels.
+func (e *Engine) cachedEval(eval int) int {
+	var evaluator = e.evaluator
+	if egtb, ok := evaluator.(*egtbEvaluator); ok {
+		evaluator = egtb.Evaluator
+	}
+	if evaluator != e.staticEvaluator {
+		return VALUE_INFINITE
+	}
+	return eval
 }
 
-func SendResultToUci(si SearchInfo) {
-	fmt.Println(si.String())
-	if len(si.MainLine) > 0 {
-		fmt.Printf("bestmove %v\n", si.MainLine[0])
+// updateSelDepth keeps the maximum height reached by the thread in its root context.
+func (ctx *searchContext) updateSelDepth() {
+	var root = &ctx.Engine.tree[ctx.Thread][0]
+	if ctx.Height > root.SelDepth {
+		root.SelDepth = ctx.Height
 	}
 }
 
@@ -99,8 +148,32 @@ func (ctx *searchContext) Next() *searchContext {
 	return &ctx.Engine.tree[ctx.Thread][ctx.Height+1]
 }
 
-func (ctx *searchContext) NextOnThread(thread int) *searchContext {
-	return &ctx.Engine.tree[thread][ctx.Height+1]
+// PrevMoves returns the moves of the previous two plies.
+func (ctx *searchContext) PrevMoves() (prevMove1, prevMove2 Move) {
+	prevMove1 = ctx.Position.LastMove
+	if ctx.Height > 0 {
+		prevMove2 = ctx.Engine.tree[ctx.Thread][ctx.Height-1].Position.LastMove
+	}
+	return
+}
+
+// DrawValue returns the draw score for the side to move. With contempt
+// the root side prefers to avoid draws and the opponent to reach them.
+func (ctx *searchContext) DrawValue() int {
+	if ctx.Height%2 == 0 {
+		return VALUE_DRAW - ctx.Engine.contempt
+	}
+	return VALUE_DRAW + ctx.Engine.contempt
+}
+
+// rootContempt scales the Contempt option by game phase:
+// full contempt with all pieces on the board, half contempt in pawn endgames.
+func (e *Engine) rootContempt(p *Position) int {
+	if e.AnalyseMode.Value {
+		return 0
+	}
+	var phase = min(64, 3*PopCount(p.Knights|p.Bishops)+5*PopCount(p.Rooks)+10*PopCount(p.Queens))
+	return e.Contempt.Value * (64 + phase) / 128
 }
 
 func (ctx *searchContext) IsDraw() bool {
@@ -226,22 +299,67 @@ func GetLeastValuableAttacker(p *Position, to int, side bool, occ uint64) (attac
 	return
 }
 
+var seeValues = [...]int{0, 100, 400, 400, 600, 1200, 12000}
+
 func SEE_GE(p *Position, move Move) bool {
+	return SEEThreshold(p, move, 0)
+}
+
+// SEE returns the material balance of the exchange sequence started by move,
+// when both sides recapture with their least valuable attacker or stop.
+func SEE(p *Position, move Move) int {
+	var gain [32]int
 	var piece = move.MovingPiece()
-	var score0 = pieceValuesSEE[move.CapturedPiece()]
+	var to = move.To()
+	gain[0] = seeValues[move.CapturedPiece()]
 	if promotion := move.Promotion(); promotion != Empty {
-		piece = move.Promotion()
-		score0 += pieceValuesSEE[promotion] - pieceValuesSEE[Pawn]
+		piece = promotion
+		gain[0] += seeValues[promotion] - seeValues[Pawn]
 	}
-	var to = move.To()
-	var occ = p.White ^ p.Black ^ squareMask[move.From()]
-	occ |= squareMask[to]
+	var occ = seeOccupancy(p, move)
 	var side = !p.WhiteMove
-	var relativeStm = true
-	var balance = score0 - pieceValuesSEE[piece]
+	var d = 0
+	for d+1 < len(gain) {
+		var nextVictim, from = GetLeastValuableAttacker(p, to, side, occ)
+		if nextVictim == Empty {
+			break
+		}
+		if nextVictim == King {
+			if victim, _ := GetLeastValuableAttacker(p, to, !side, occ^squareMask[from]); victim != Empty {
+				break
+			}
+		}
+		d++
+		gain[d] = seeValues[piece] - gain[d-1]
+		occ ^= squareMask[from]
+		piece = nextVictim
+		side = !side
+	}
+	for ; d > 0; d-- {
+		gain[d-1] = -max(-gain[d-1], gain[d])
+	}
+	return gain[0]
+}
+
+// SEEThreshold reports whether SEE(p, move) >= threshold without computing the exact value.
+func SEEThreshold(p *Position, move Move, threshold int) bool {
+	var piece = move.MovingPiece()
+	var balance = seeValues[move.CapturedPiece()] - threshold
+	if promotion := move.Promotion(); promotion != Empty {
+		piece = promotion
+		balance += seeValues[promotion] - seeValues[Pawn]
+	}
+	if balance < 0 {
+		return false
+	}
+	balance -= seeValues[piece]
 	if balance >= 0 {
 		return true
 	}
+	var to = move.To()
+	var occ = seeOccupancy(p, move)
+	var side = !p.WhiteMove
+	var relativeStm = true
 	for {
 		var nextVictim, from = GetLeastValuableAttacker(p, to, side, occ)
 		if nextVictim == Empty {
@@ -253,9 +371,9 @@ func SEE_GE(p *Position, move Move) bool {
 		occ ^= squareMask[from]
 		piece = nextVictim
 		if relativeStm {
-			balance += pieceValuesSEE[nextVictim]
+			balance += seeValues[nextVictim]
 		} else {
-			balance -= pieceValuesSEE[nextVictim]
+			balance -= seeValues[nextVictim]
 		}
 		relativeStm = !relativeStm
 		if relativeStm == (balance >= 0) {
@@ -264,3 +382,12 @@ func SEE_GE(p *Position, move Move) bool {
 		side = !side
 	}
 }
+
+func seeOccupancy(p *Position, move Move) uint64 {
+	var to = move.To()
+	var occ = (p.White|p.Black)&^squareMask[move.From()] | squareMask[to]
+	if move.MovingPiece() == Pawn && to == p.EpSquare && p.EpSquare != SquareNone {
+		occ &^= squareMask[to+let(p.WhiteMove, -8, 8)]
+	}
+	return occ
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Strength limiting. A skill level below MaxSkillLevel weakens play in three ways:
+// the search is limited by nodes, static evaluation gets a deterministic noise,
+// and the best move is chosen among SkillMultiPV lines with a random bias
+// to weaker moves.
+// The UCI_Elo range MinElo..MaxElo is nominal: the values are not ratings measured
+// against a rating pool, they only order the skill levels.
+const (
+	MaxSkillLevel = 20
+	MinElo        = 1000
+	MaxElo        = 2800
+	SkillMultiPV  = 4
+)
+
+// skillLevel returns the effective skill level. UCI_Elo overrides Skill Level
+// if UCI_LimitStrength is on.
+func (e *Engine) skillLevel() int {
+	if e.LimitStrength.Value {
+		return EloToSkillLevel(e.Elo.Value)
+	}
+	return e.SkillLevel.Value
+}
+
+func (e *Engine) skillEnabled() bool {
+	return e.skillLevel() < MaxSkillLevel
+}
+
+// EloToSkillLevel maps the nominal UCI_Elo linearly to the skill level.
+// The calibrate shell command measures the Elo differences between the settings
+// in self-play, it does not anchor them to real ratings.
+func EloToSkillLevel(elo int) int {
+	elo = max(MinElo, min(MaxElo, elo))
+	return (elo - MinElo) * MaxSkillLevel / (MaxElo - MinElo)
+}
+
+// skillNodes doubles the node limit every two skill levels.
+func skillNodes(level int) int64 {
+	var nodes = int64(1000) << uint(level/2)
+	if level%2 != 0 {
+		nodes = nodes * 3 / 2
+	}
+	return nodes
+}
+
+func skillEvalNoise(level int) int {
+	return (MaxSkillLevel - level) * 8
+}
+
+// multiPV is the number of lines searched. Limited strength searches
+// extra lines to choose from, reportedLines hides them.
+func (e *Engine) multiPV() int {
+	if e.skillEnabled() {
+		return max(e.MultiPV.Value, SkillMultiPV)
+	}
+	return e.MultiPV.Value
+}
+
+// reportedLines returns the lines the MultiPV option asks for.
+func (e *Engine) reportedLines(lines []SearchLine) []SearchLine {
+	if len(lines) > e.MultiPV.Value {
+		return lines[:e.MultiPV.Value]
+	}
+	return lines
+}
+
+// skillProgress reports search progress without the extra lines of limited strength.
+func (e *Engine) skillProgress(progress func(SearchInfo)) func(SearchInfo) {
+	return func(si SearchInfo) {
+		si.Lines = e.reportedLines(si.Lines)
+		progress(si)
+	}
+}
+
+// initRandom seeds the generator shared by skill levels and the opening book.
+func (e *Engine) initRandom() {
+	if e.random == nil {
+		var seed = e.RandomSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		e.random = rand.New(rand.NewSource(seed))
+	}
+}
+
+// prepareSkill sets the node limit and the evaluation noise for the next search.
+func (e *Engine) prepareSkill() {
+	e.initRandom()
+	e.evaluator = e.staticEvaluator
+	if !e.skillEnabled() {
+		return
+	}
+	var level = e.skillLevel()
+	e.timeManager.LimitNodes(skillNodes(level))
+	e.evaluator = &noisyEvaluator{
+		Evaluator: e.staticEvaluator,
+		amplitude: skillEvalNoise(level),
+		seed:      e.random.Uint64(),
+	}
+}
+
+// pickSkillLine chooses a line among the best lines. The weaker the skill level
+// the more often a line with lower score is chosen.
+func (e *Engine) pickSkillLine(lines []SearchLine) SearchLine {
+	var level = e.skillLevel()
+	var weakness = 120 - 2*level
+	var topScore = lines[0].Score
+	var delta = min(topScore-lines[len(lines)-1].Score, PawnValue)
+	var best = lines[0]
+	var bestScore = -VALUE_INFINITE
+	for _, line := range lines {
+		var push = (weakness*(topScore-line.Score) + delta*e.random.Intn(weakness)) / 128
+		if line.Score+push > bestScore {
+			bestScore = line.Score + push
+			best = line
+		}
+	}
+	return best
+}
+
+type noisyEvaluator struct {
+	Evaluator
+	amplitude int
+	seed      uint64
+}
+
+// Evaluate adds to the static evaluation a noise that depends only on the position,
+// so that the search sees the same value for the same position.
+func (e *noisyEvaluator) Evaluate(p *Position) int {
+	var x = p.Key ^ e.seed
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	var noise = int(x%uint64(2*e.amplitude+1)) - e.amplitude
+	return e.Evaluator.Evaluate(p) + noise
+}
@@ -0,0 +1,331 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/ChizhovVadim/CounterGo/syzygy"
+)
+
+// States of tablebase probes. Table values assume that captures are not better
+// than other moves, probes resolve captures with a small search.
+const (
+	tbFail = iota
+	tbOK
+	// tbZeroingBestMove: the best move is a capture or a pawn move.
+	tbZeroingBestMove
+)
+
+// maxDTZ ranks root moves, larger than any DTZ of the tables.
+const maxDTZ = 1 << 18
+
+func (e *Engine) loadTablebases() {
+	if e.tablebases != nil {
+		e.tablebases.Close()
+	}
+	e.tablebases, e.tablebasesErr = nil, nil
+	e.tablebasesPath = e.SyzygyPath.Value
+	if e.SyzygyPath.Value == "" {
+		return
+	}
+	var tb, err = syzygy.Open(e.SyzygyPath.Value)
+	if err != nil {
+		e.tablebasesErr = err
+		return
+	}
+	if tb.MaxPieces() > 0 {
+		e.tablebases = tb
+	}
+}
+
+// TablebasesInfo describes the tables found in the SyzygyPath directories.
+func (e *Engine) TablebasesInfo() string {
+	if e.tablebasesErr != nil {
+		return fmt.Sprintf("Syzygy tablebases not loaded: %v", e.tablebasesErr)
+	}
+	if e.SyzygyPath.Value == "" {
+		return "Syzygy tablebases off"
+	}
+	if e.tablebases == nil {
+		return "Syzygy tablebases not found"
+	}
+	return fmt.Sprintf("Found %v Syzygy tablebases, up to %v pieces",
+		e.tablebases.Len(), e.tablebases.MaxPieces())
+}
+
+func toSyzygyPosition(p *Position) *syzygy.Position {
+	return &syzygy.Position{
+		Pawns:     p.Pawns,
+		Knights:   p.Knights,
+		Bishops:   p.Bishops,
+		Rooks:     p.Rooks,
+		Queens:    p.Queens,
+		Kings:     p.Kings,
+		White:     p.White,
+		Black:     p.Black,
+		WhiteMove: p.WhiteMove,
+	}
+}
+
+// canProbe reports whether p is in the tables.
+func (e *Engine) canProbe(p *Position) bool {
+	return e.tablebases != nil && p.CastleRights == 0 &&
+		PopCount(p.White|p.Black) <= e.tablebases.MaxPieces()
+}
+
+// probeWDL returns the result of p with the 50 move rule, from syzygy.Loss to syzygy.Win.
+func (e *Engine) probeWDL(p *Position) (wdl int, ok bool) {
+	var result, state = e.tbSearch(p, false)
+	return result, state != tbFail
+}
+
+// tbSearch probes the table of p and the captures of p, with checkZeroing also
+// the pawn moves. The table value is right if no such move is better.
+func (e *Engine) tbSearch(p *Position, checkZeroing bool) (wdl, state int) {
+	var buffer [MAX_MOVES]Move
+	var child Position
+	var bestValue = syzygy.Loss
+	var moveCount, legalMoves = 0, 0
+	for _, move := range GenerateMoves(p, buffer[:]) {
+		if !p.MakeMove(move, &child) {
+			continue
+		}
+		legalMoves++
+		if move.CapturedPiece() == Empty &&
+			(!checkZeroing || move.MovingPiece() != Pawn) {
+			continue
+		}
+		moveCount++
+		var value, childState = e.tbSearch(&child, false)
+		if childState == tbFail {
+			return 0, tbFail
+		}
+		value = -value
+		if value > bestValue {
+			bestValue = value
+			if value >= syzygy.Win {
+				return value, tbZeroingBestMove
+			}
+		}
+	}
+
+	// All moves are zeroing, the table value is not needed.
+	var noMoreMoves = moveCount != 0 && moveCount == legalMoves
+	var value int
+	if noMoreMoves {
+		value = bestValue
+	} else {
+		var ok bool
+		value, ok = e.tablebases.ProbeWDLTable(toSyzygyPosition(p))
+		if !ok {
+			return 0, tbFail
+		}
+	}
+	if bestValue >= value {
+		if bestValue > syzygy.Draw || noMoreMoves {
+			return bestValue, tbZeroingBestMove
+		}
+		return bestValue, tbOK
+	}
+	return value, tbOK
+}
+
+// dtzBeforeZeroing returns the DTZ of a position whose best move is zeroing.
+func dtzBeforeZeroing(wdl int) int {
+	switch wdl {
+	case syzygy.Win:
+		return 1
+	case syzygy.CursedWin:
+		return 101
+	case syzygy.BlessedLoss:
+		return -101
+	case syzygy.Loss:
+		return -1
+	}
+	return 0
+}
+
+func sign(x int) int {
+	if x > 0 {
+		return 1
+	}
+	if x < 0 {
+		return -1
+	}
+	return 0
+}
+
+// probeDTZ returns the number of plies to a capture or pawn move that keeps the result
+// of p, positive for a win and negative for a loss. 100 plies are added to
+// the DTZ of cursed wins and blessed losses. The DTZ of a draw is 0.
+func (e *Engine) probeDTZ(p *Position) (dtz int, ok bool) {
+	var wdl, state = e.tbSearch(p, true)
+	if state == tbFail || wdl == syzygy.Draw {
+		return 0, state != tbFail
+	}
+	if state == tbZeroingBestMove {
+		return dtzBeforeZeroing(wdl), true
+	}
+
+	var value, tableState = e.tablebases.ProbeDTZTable(toSyzygyPosition(p), wdl)
+	if tableState == syzygy.ProbeFail {
+		return 0, false
+	}
+	if tableState == syzygy.ProbeOK {
+		if wdl == syzygy.CursedWin || wdl == syzygy.BlessedLoss {
+			value += 100
+		}
+		return value * sign(wdl), true
+	}
+
+	// The table stores the other side to move, search one ply.
+	var buffer [MAX_MOVES]Move
+	var child Position
+	var minDTZ = maxDTZ
+	for _, move := range GenerateMoves(p, buffer[:]) {
+		if !p.MakeMove(move, &child) {
+			continue
+		}
+		var zeroing = move.CapturedPiece() != Empty || move.MovingPiece() == Pawn
+		var childDTZ int
+		if zeroing {
+			var childWDL, childState = e.tbSearch(&child, false)
+			if childState == tbFail {
+				return 0, false
+			}
+			childDTZ = -dtzBeforeZeroing(childWDL)
+		} else {
+			var childOK bool
+			childDTZ, childOK = e.probeDTZ(&child)
+			if !childOK {
+				return 0, false
+			}
+			childDTZ = -childDTZ
+		}
+		// A mating move has DTZ 1.
+		if childDTZ == 1 && child.IsCheck() && len(GenerateLegalMoves(&child)) == 0 {
+			minDTZ = 1
+		}
+		if !zeroing {
+			childDTZ += sign(childDTZ)
+		}
+		if childDTZ < minDTZ && sign(childDTZ) == sign(wdl) {
+			minDTZ = childDTZ
+		}
+	}
+	if minDTZ == maxDTZ {
+		// no legal moves: mated
+		return -1, true
+	}
+	return minDTZ, true
+}
+
+// tbRootMoves keeps the root moves that win, or draw, or lose slowest
+// according to the DTZ tables. Wins within the 50 move rule rank equally
+// unless the game has repeated since the last capture or pawn move,
+// then only the fastest wins are kept to make progress.
+// ok is false if the root position is not in the tables.
+func (ctx *searchContext) tbRootMoves(ml []Move) (result []Move, ok bool) {
+	var engine = ctx.Engine
+	var position = ctx.Position
+	if !engine.canProbe(position) {
+		return ml, false
+	}
+	var rule50 = position.Rule50
+	var repeated = hasRepeated(engine.historyKeys)
+	var ranks = make([]int, len(ml))
+	var bestRank = -maxDTZ - 1
+	var child Position
+	for i, move := range ml {
+		position.MakeMove(move, &child)
+		var dtz int
+		ok = true
+		if child.Rule50 == 0 {
+			var wdl int
+			wdl, ok = engine.probeWDL(&child)
+			dtz = dtzBeforeZeroing(-wdl)
+		} else if isRepetition(engine.historyKeys, child.Key) {
+			dtz = 0
+		} else {
+			dtz, ok = engine.probeDTZ(&child)
+			dtz = -dtz
+			dtz += sign(dtz)
+		}
+		engine.timeManager.IncTBHits()
+		if !ok {
+			return ml, false
+		}
+		if child.IsCheck() && dtz == 2 && len(GenerateLegalMoves(&child)) == 0 {
+			dtz = 1
+		}
+
+		var rank = 0
+		if dtz > 0 {
+			if dtz+rule50 <= 99 && !repeated {
+				rank = maxDTZ
+			} else {
+				rank = maxDTZ - (dtz + rule50)
+			}
+		} else if dtz < 0 {
+			if -dtz*2+rule50 < 100 {
+				rank = -maxDTZ
+			} else {
+				rank = -maxDTZ + (-dtz + rule50)
+			}
+		}
+		ranks[i] = rank
+		bestRank = max(bestRank, rank)
+	}
+
+	for i, move := range ml {
+		if ranks[i] == bestRank {
+			result = append(result, move)
+		}
+	}
+	return result, true
+}
+
+func hasRepeated(keys []uint64) bool {
+	for i := range keys {
+		if isRepetition(keys[:i], keys[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRepetition(keys []uint64, key uint64) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// probeTablebases returns the score of a position in the WDL tables.
+// Cursed wins and blessed losses score near a draw.
+// If the root moves were ranked by the DTZ tables, the search does not probe.
+func (ctx *searchContext) probeTablebases(depth int) (score, bound int, ok bool) {
+	var engine = ctx.Engine
+	var position = ctx.Position
+	if !engine.canProbe(position) || position.Rule50 != 0 ||
+		engine.tree[ctx.Thread][0].rootInTB {
+		return
+	}
+	var pieces = PopCount(position.White | position.Black)
+	if pieces == engine.tablebases.MaxPieces() && depth < engine.SyzygyProbeDepth.Value {
+		return
+	}
+	var wdl int
+	if wdl, ok = engine.probeWDL(position); !ok {
+		return
+	}
+	engine.timeManager.IncTBHits()
+	switch {
+	case wdl < syzygy.BlessedLoss:
+		return VALUE_MATED_IN_MAX_HEIGHT + ctx.Height + 1, Upper, true
+	case wdl > syzygy.CursedWin:
+		return VALUE_MATE_IN_MAX_HEIGHT - ctx.Height - 1, Lower, true
+	}
+	return ctx.DrawValue() + 2*wdl, Lower | Upper, true
+}
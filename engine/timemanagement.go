@@ -1,49 +1,182 @@
 package engine
 
 import (
-	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// CancellationToken lets the caller stop a search from another goroutine.
 type CancellationToken struct {
-	active bool
+	active int32
+	mu     sync.Mutex
+	done   chan struct{}
 }
 
 func (ct *CancellationToken) Cancel() {
-	ct.active = true
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if atomic.LoadInt32(&ct.active) == 0 {
+		atomic.StoreInt32(&ct.active, 1)
+		if ct.done != nil {
+			close(ct.done)
+		}
+	}
+}
+
+// Done returns a channel that is closed on Cancel.
+func (ct *CancellationToken) Done() <-chan struct{} {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.done == nil {
+		ct.done = make(chan struct{})
+		if atomic.LoadInt32(&ct.active) != 0 {
+			close(ct.done)
+		}
+	}
+	return ct.done
 }
 
 func (ct *CancellationToken) IsCancellationRequested() bool {
-	return ct.active
+	return atomic.LoadInt32(&ct.active) != 0
+}
+
+// PonderToken signals that the opponent played the expected move,
+// so a ponder search continues as a normal timed search.
+type PonderToken struct {
+	mu    sync.Mutex
+	hit   bool
+	onHit func()
+}
+
+func (pt *PonderToken) PonderHit() {
+	pt.mu.Lock()
+	var onHit = pt.onHit
+	pt.hit = true
+	pt.onHit = nil
+	pt.mu.Unlock()
+	if onHit != nil {
+		onHit()
+	}
+}
+
+func (pt *PonderToken) IsPonderHit() bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.hit
+}
+
+func (pt *PonderToken) setHandler(onHit func()) {
+	pt.mu.Lock()
+	if !pt.hit {
+		pt.onHit = onHit
+		onHit = nil
+	}
+	pt.mu.Unlock()
+	if onHit != nil {
+		onHit()
+	}
 }
 
-var searchTimeout = errors.New("search timeout")
+// A search thread publishes its node count and checks the limits every
+// NodesCheckInterval nodes. Node limited searches check more often to stop precisely.
+const (
+	NodesCheckInterval     = 1024
+	NodeLimitCheckInterval = 64
+)
+
+// nodeCounter is owned by one search thread. It takes a whole cache line,
+// so that threads counting nodes do not slow each other down.
+type nodeCounter struct {
+	nodes     int64
+	published int64
+	_         [48]byte
+}
+
+func (c *nodeCounter) publish() {
+	atomic.StoreInt64(&c.published, c.nodes)
+}
 
 type timeControlStrategy func(main, inc, moves int) (softLimit, hardLimit int)
 
+// timeControlStrategies are the values of the TimeControl option.
+var timeControlStrategies = map[string]timeControlStrategy{
+	"Basic":    TimeControlBasic,
+	"Cautious": TimeControlCautious,
+}
+
 type timeManager struct {
-	start                       time.Time
-	softTime                    time.Duration
-	nodes, softNodes, hardNodes int64
-	ct                          *CancellationToken
-	timer                       *time.Timer
+	start                time.Time
+	softNodes, hardNodes int64
+	counters             []nodeCounter
+	checkMask            int64
+	tbHits               int64
+	ct                   *CancellationToken
+	stopped              int32
+	limits               LimitsType
+	side                 bool
+	timeControlStrategy  timeControlStrategy
+	mu                   sync.Mutex
+	pondering            bool
+	clockStarted         chan struct{}
+	clockStart           time.Time
+	softTime             time.Duration
+	timer                *time.Timer
 }
 
+// Nodes sums the node counts published by search threads.
 func (tm *timeManager) Nodes() int64 {
-	return tm.nodes
+	var result int64
+	for i := range tm.counters {
+		result += atomic.LoadInt64(&tm.counters[i].published)
+	}
+	return result
+}
+
+func (tm *timeManager) TBHits() int64 {
+	return atomic.LoadInt64(&tm.tbHits)
+}
+
+func (tm *timeManager) IncTBHits() {
+	atomic.AddInt64(&tm.tbHits, 1)
+}
+
+// LimitNodes stops the search after nodes even if other limits allow more.
+func (tm *timeManager) LimitNodes(nodes int64) {
+	if tm.hardNodes == 0 || nodes < tm.hardNodes {
+		tm.hardNodes = nodes
+	}
+	tm.checkMask = NodeLimitCheckInterval - 1
 }
 
 func (tm *timeManager) IsHardTimeout() bool {
 	return tm.ct.IsCancellationRequested() ||
-		tm.hardNodes > 0 && tm.nodes >= tm.hardNodes
+		atomic.LoadInt32(&tm.stopped) != 0 ||
+		tm.hardNodes > 0 && tm.Nodes() >= tm.hardNodes
+}
+
+// Stop is called by the main thread when it finishes, so that helper threads stop too.
+func (tm *timeManager) Stop() {
+	atomic.StoreInt32(&tm.stopped, 1)
 }
 
-func (tm *timeManager) IncNodes() {
-	atomic.AddInt64(&tm.nodes, 1)
-	if tm.IsHardTimeout() {
-		panic(searchTimeout)
+// IncNodes counts the node of the search thread and reports whether the search must stop.
+// Once it returns true, IsStopped returns true for all threads.
+func (tm *timeManager) IncNodes(counter *nodeCounter) bool {
+	counter.nodes++
+	if counter.nodes&tm.checkMask == 0 {
+		counter.publish()
+		if tm.IsHardTimeout() {
+			tm.Stop()
+		}
 	}
+	return tm.IsStopped()
+}
+
+// IsStopped reports whether the search is stopped. The results of searches
+// in progress are incomplete then and must not be used or stored.
+func (tm *timeManager) IsStopped() bool {
+	return atomic.LoadInt32(&tm.stopped) != 0
 }
 
 func (tm *timeManager) ElapsedMilliseconds() int64 {
@@ -51,18 +184,41 @@ func (tm *timeManager) ElapsedMilliseconds() int64 {
 }
 
 func (tm *timeManager) IsSoftTimeout() bool {
-	return (tm.softTime > 0 && time.Since(tm.start) >= tm.softTime) ||
-		(tm.softNodes > 0 && tm.nodes >= tm.softNodes)
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return (tm.softTime > 0 && time.Since(tm.clockStart) >= tm.softTime) ||
+		(tm.softNodes > 0 && tm.Nodes() >= tm.softNodes)
+}
+
+func (tm *timeManager) IsPondering() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.pondering
+}
+
+// WaitForStop blocks while the search is not allowed to finish on its own:
+// an infinite search runs until stop, a ponder search until stop or ponderhit.
+func (tm *timeManager) WaitForStop() {
+	if tm.limits.Infinite {
+		<-tm.ct.Done()
+		return
+	}
+	select {
+	case <-tm.ct.Done():
+	case <-tm.clockStarted:
+	}
 }
 
 func (tm *timeManager) Close() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 	if t := tm.timer; t != nil {
 		t.Stop()
 	}
 }
 
 func NewTimeManager(limits LimitsType, timeControlStrategy timeControlStrategy,
-	side bool, ct *CancellationToken) *timeManager {
+	side bool, ct *CancellationToken, pt *PonderToken) *timeManager {
 	var start = time.Now()
 
 	if timeControlStrategy == nil {
@@ -73,41 +229,76 @@ func NewTimeManager(limits LimitsType, timeControlStrategy timeControlStrategy,
 		ct = &CancellationToken{}
 	}
 
+	var tm = &timeManager{
+		start:               start,
+		ct:                  ct,
+		limits:              limits,
+		side:                side,
+		timeControlStrategy: timeControlStrategy,
+		checkMask:           NodesCheckInterval - 1,
+		clockStarted:        make(chan struct{}),
+	}
+
+	var _, _, softNodes, hardNodes = tm.computeLimits()
+	tm.softNodes = int64(softNodes)
+	tm.hardNodes = int64(hardNodes)
+	if hardNodes > 0 || softNodes > 0 {
+		tm.checkMask = NodeLimitCheckInterval - 1
+	}
+
+	if limits.Ponder && pt != nil {
+		tm.pondering = true
+		pt.setHandler(tm.startClock)
+	} else {
+		tm.startClock()
+	}
+	return tm
+}
+
+// startClock applies the time limits. For a ponder search it is called on ponderhit.
+func (tm *timeManager) startClock() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.pondering = false
+	close(tm.clockStarted)
+	tm.clockStart = time.Now()
+	var softTime, hardTime, _, _ = tm.computeLimits()
+	tm.softTime = time.Duration(softTime) * time.Millisecond
+	if hardTime > 0 {
+		var ct = tm.ct
+		tm.timer = time.AfterFunc(time.Duration(hardTime)*time.Millisecond, func() {
+			ct.Cancel()
+		})
+	}
+}
+
+func (tm *timeManager) computeLimits() (softTime, hardTime, softNodes, hardNodes int) {
+	var limits = tm.limits
+	if limits.Infinite {
+		return
+	}
+
 	var main, increment int
-	if side {
+	if tm.side {
 		main, increment = limits.WhiteTime, limits.WhiteIncrement
 	} else {
 		main, increment = limits.BlackTime, limits.BlackIncrement
 	}
 
-	var softTime, hardTime, softNodes, hardNodes int
 	if limits.MoveTime > 0 {
 		hardTime = limits.MoveTime
 	} else if limits.Nodes > 0 {
 		hardNodes = limits.Nodes
-	} else if main > 0 {
-		var softLimit, hardLimit = timeControlStrategy(main, increment, limits.MovesToGo)
+	} else if limits.WhiteTime != 0 || limits.BlackTime != 0 {
+		// A GUI may send zero or negative time if the engine is late, then move at once.
+		var softLimit, hardLimit = tm.timeControlStrategy(max(main, 0), increment, limits.MovesToGo)
 		if limits.IsNodeLimits {
 			softNodes, hardNodes = softLimit, hardLimit
 		} else {
 			softTime, hardTime = softLimit, hardLimit
 		}
 	}
-
-	var timer *time.Timer
-	if hardTime > 0 {
-		timer = time.AfterFunc(time.Duration(hardTime)*time.Millisecond, func() {
-			ct.Cancel()
-		})
-	}
-	return &timeManager{
-		start:     start,
-		timer:     timer,
-		ct:        ct,
-		hardNodes: int64(hardNodes),
-		softNodes: int64(softNodes),
-		softTime:  time.Duration(softTime) * time.Millisecond,
-	}
+	return
 }
 
 func computeLimit(main, inc, moves int) int {
@@ -135,3 +326,10 @@ func TimeControlBasic(main, inc, moves int) (softLimit, hardLimit int) {
 
 	return
 }
+
+// TimeControlCautious spends less time than TimeControlBasic.
+// It suits a GUI with a large communication delay.
+func TimeControlCautious(main, inc, moves int) (softLimit, hardLimit int) {
+	softLimit, hardLimit = TimeControlBasic(main, inc, moves)
+	return softLimit * 2 / 3, max(hardLimit/2, 1)
+}
@@ -5,20 +5,21 @@ import (
 	"sync/atomic"
 )
 
+// transTable is a lockless hash table. Entries are written without locks, so
+// a thread may read an entry while another thread writes it. The key word is stored
+// XOR the data word, a torn entry fails the key check and looks like a miss.
 type transTable struct {
 	megabytes  int
 	entries    []transEntry
+	clusters   uint64
 	generation uint8
-	mask       uint32
 }
 
+// transEntry key word: key>>32 in the high half, depth, bound and generation in the low half.
+// Data word: move, score and static evaluation.
 type transEntry struct {
-	gate      int32
-	key32     uint32
-	move      Move
-	score     int16
-	depth     int8
-	bound_gen uint8
+	key  uint64
+	data uint64
 }
 
 const (
@@ -26,14 +27,18 @@ const (
 	Upper
 )
 
+// A cluster of entries takes a cache line.
 const ClusterSize = 4
 
+// MaxHash is the largest hash size in megabytes.
+const MaxHash = 1 << 16
+
 func NewTransTable(megabytes int) *transTable {
-	var size = 1024 * 1024 * megabytes / 16
+	var clusters = uint64(megabytes) * 1024 * 1024 / (16 * ClusterSize)
 	return &transTable{
 		megabytes: megabytes,
-		entries:   make([]transEntry, size+ClusterSize-1),
-		mask:      uint32(size - 1),
+		entries:   make([]transEntry, clusters*ClusterSize),
+		clusters:  clusters,
 	}
 }
 
@@ -47,52 +52,105 @@ func (tt *transTable) Clear() {
 	}
 }
 
-func (tt *transTable) Read(p *Position) (depth, score, bound int, move Move, ok bool) {
-	var index = int(uint32(p.Key) & tt.mask)
-	for i := 0; i < ClusterSize; i++ {
-		var entry = &tt.entries[index+i]
-		if entry.key32 == uint32(p.Key>>32) &&
-			atomic.CompareAndSwapInt32(&entry.gate, 0, 1) {
-			if entry.key32 == uint32(p.Key>>32) {
-				entry.bound_gen = (entry.bound_gen & 3) + (tt.generation << 2)
-				score = int(entry.score)
-				move = entry.move
-				depth = int(entry.depth)
-				bound = int(entry.bound_gen & 3)
-				ok = true
-			}
-			atomic.StoreInt32(&entry.gate, 0)
-			break
+// cluster maps the low half of the key to a cluster, the table size needs not be a power of two.
+// The high half of the key is verified by Read.
+func (tt *transTable) cluster(key uint64) []transEntry {
+	var index = (key & 0xffffffff) * tt.clusters >> 32
+	return tt.entries[index*ClusterSize : (index+1)*ClusterSize]
+}
+
+func packKey(key uint64, depth, bound int, gen uint8) uint64 {
+	return key&0xffffffff00000000 | uint64(uint8(depth)) | uint64(bound)<<8 | uint64(gen)<<10
+}
+
+func packData(move Move, score, eval int) uint64 {
+	return uint64(uint32(move)) | uint64(uint16(score))<<32 | uint64(uint16(eval))<<48
+}
+
+func unpackKey(w uint64) (depth int8, bound int, gen uint8) {
+	return int8(w), int(w>>8) & 3, uint8(w>>10) & 63
+}
+
+func unpackData(data uint64) (move Move, score, eval int) {
+	return Move(uint32(data)), int(int16(data >> 32)), int(int16(data >> 48))
+}
+
+func (entry *transEntry) load() (key, data uint64) {
+	data = atomic.LoadUint64(&entry.data)
+	key = atomic.LoadUint64(&entry.key) ^ data
+	return
+}
+
+func (entry *transEntry) store(key, data uint64) {
+	atomic.StoreUint64(&entry.data, data)
+	atomic.StoreUint64(&entry.key, key^data)
+}
+
+// Read returns the entry of the position. Static evaluation is VALUE_INFINITE if it is unknown.
+func (tt *transTable) Read(p *Position) (depth, score, eval, bound int, move Move, ok bool) {
+	var cluster = tt.cluster(p.Key)
+	for i := range cluster {
+		var entry = &cluster[i]
+		var key, data = entry.load()
+		if key>>32 != p.Key>>32 {
+			continue
+		}
+		var d, b, gen = unpackKey(key)
+		if b == 0 {
+			continue
 		}
+		if gen != tt.generation {
+			entry.store(packKey(key, int(d), b, tt.generation), data)
+		}
+		move, score, eval = unpackData(data)
+		return int(d), score, eval, b, move, true
 	}
 	return
 }
 
-//position fen 8/k7/3p4/p2P1p2/P2P1P2/8/8/K7 w - - 0 1
-func (tt *transTable) Update(p *Position, depth, score, bound int, move Move) {
-	var index = int(uint32(p.Key) & tt.mask)
+// Update stores the entry in the slot of the same position, or else replaces
+// the least valuable entry of the cluster. A write is never skipped.
+// position fen 8/k7/3p4/p2P1p2/P2P1P2/8/8/K7 w - - 0 1
+func (tt *transTable) Update(p *Position, depth, score, eval, bound int, move Move) {
+	var cluster = tt.cluster(p.Key)
 	var bestEntry *transEntry
 	var bestScore = -32767
-	for i := 0; i < ClusterSize; i++ {
-		var entry = &tt.entries[index+i]
-		if entry.key32 == uint32(p.Key>>32) {
+	for i := range cluster {
+		var entry = &cluster[i]
+		var key, data = entry.load()
+		var oldDepth, oldBound, gen = unpackKey(key)
+		if key>>32 == p.Key>>32 && oldBound != 0 {
+			if move == MoveEmpty {
+				move, _, _ = unpackData(data)
+			}
 			bestEntry = entry
 			break
 		}
-		var score = Score(entry.depth, entry.bound_gen>>2, tt.generation)
+		var score = Score(oldDepth, gen, tt.generation)
+		if oldBound == 0 {
+			score += 200
+		}
 		if score > bestScore {
 			bestScore = score
 			bestEntry = entry
 		}
 	}
-	if atomic.CompareAndSwapInt32(&bestEntry.gate, 0, 1) {
-		bestEntry.key32 = uint32(p.Key >> 32)
-		bestEntry.move = move
-		bestEntry.score = int16(score)
-		bestEntry.depth = int8(depth)
-		bestEntry.bound_gen = uint8(bound) + (tt.generation << 2)
-		atomic.StoreInt32(&bestEntry.gate, 0)
+	bestEntry.store(packKey(p.Key, depth, bound, tt.generation), packData(move, score, eval))
+}
+
+// HashFull returns the permille of the first entries written in the current search.
+func (tt *transTable) HashFull() int {
+	const sampleSize = 1000
+	var count = min(sampleSize, len(tt.entries))
+	var used = 0
+	for i := 0; i < count; i++ {
+		var key, _ = tt.entries[i].load()
+		var _, bound, gen = unpackKey(key)
+		if bound != 0 && gen == tt.generation {
+			used++
+		}
 	}
+	return used * 1000 / count
 }
 
 func Score(depth int8, gen, curGen uint8) int {
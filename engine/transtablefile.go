@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Hash file layout, all numbers little endian:
+//
+//	magic      [8]byte "CNTRHASH"
+//	version    uint32
+//	zobrist    uint64  checksum of the Zobrist keys
+//	megabytes  uint32
+//	entries    uint64
+//	generation uint8
+//	entries * (key uint64, data uint64) as stored in transEntry
+const (
+	hashFileMagic     = "CNTRHASH"
+	hashFileVersion   = 2
+	hashFileEntrySize = 16
+)
+
+var (
+	errWrongHashFile  = errors.New("not a hash file")
+	errHashFileNotSet = errors.New("Hash File option is empty")
+)
+
+// zobristChecksum changes if the Zobrist keys change,
+// so that a table saved by another engine version is not loaded.
+func zobristChecksum() uint64 {
+	var result = sideKey
+	var mix = func(key uint64) {
+		result = (result^key)*0x100000001b3 + 0x9e3779b97f4a7c15
+	}
+	for _, key := range enpassantKey {
+		mix(key)
+	}
+	for _, key := range castlingKey {
+		mix(key)
+	}
+	for _, key := range pieceSquareKey {
+		mix(key)
+	}
+	return result
+}
+
+type hashFileHeader struct {
+	Magic      [8]byte
+	Version    uint32
+	Zobrist    uint64
+	Megabytes  uint32
+	Entries    uint64
+	Generation uint8
+}
+
+func (tt *transTable) header() hashFileHeader {
+	var result = hashFileHeader{
+		Version:    hashFileVersion,
+		Zobrist:    zobristChecksum(),
+		Megabytes:  uint32(tt.megabytes),
+		Entries:    uint64(len(tt.entries)),
+		Generation: tt.generation,
+	}
+	copy(result.Magic[:], hashFileMagic)
+	return result
+}
+
+// Save writes the table. It must not be called during a search.
+func (tt *transTable) Save(w io.Writer) error {
+	var bw = bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, tt.header()); err != nil {
+		return err
+	}
+	var buf [hashFileEntrySize]byte
+	for i := range tt.entries {
+		var entry = &tt.entries[i]
+		binary.LittleEndian.PutUint64(buf[0:], entry.key)
+		binary.LittleEndian.PutUint64(buf[8:], entry.data)
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Load reads a table saved by Save. The file must have the same version,
+// Zobrist keys and size as the table. A rejected file leaves the table unchanged,
+// a truncated file leaves it empty.
+func (tt *transTable) Load(r io.Reader) error {
+	r = bufio.NewReader(r)
+	var header hashFileHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return errWrongHashFile
+	}
+	var expected = tt.header()
+	if header.Magic != expected.Magic {
+		return errWrongHashFile
+	}
+	if header.Version != expected.Version {
+		return fmt.Errorf("hash file version %v, expected %v", header.Version, expected.Version)
+	}
+	if header.Zobrist != expected.Zobrist {
+		return errors.New("hash file has different zobrist keys")
+	}
+	if header.Megabytes != expected.Megabytes || header.Entries != expected.Entries {
+		return fmt.Errorf("hash file size %v MB, Hash is %v MB", header.Megabytes, expected.Megabytes)
+	}
+	var buf [hashFileEntrySize]byte
+	for i := range tt.entries {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			tt.Clear()
+			return fmt.Errorf("hash file truncated: %v", err)
+		}
+		tt.entries[i] = transEntry{
+			key:  binary.LittleEndian.Uint64(buf[0:]),
+			data: binary.LittleEndian.Uint64(buf[8:]),
+		}
+	}
+	tt.generation = header.Generation
+	return nil
+}
+
+// SaveHash writes the transposition table to the file set by the Hash File option.
+func (e *Engine) SaveHash() error {
+	if e.HashFile.Value == "" {
+		return errHashFileNotSet
+	}
+	e.Prepare()
+	var file, err = os.Create(e.HashFile.Value)
+	if err != nil {
+		return err
+	}
+	if err = e.transTable.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadHash replaces the transposition table with the table from the file set by the Hash File option.
+func (e *Engine) LoadHash() error {
+	if e.HashFile.Value == "" {
+		return errHashFileNotSet
+	}
+	e.Prepare()
+	var file, err = os.Open(e.HashFile.Value)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return e.transTable.Load(file)
+}
@@ -91,8 +91,13 @@ type searchContext struct {
 	mi                 moveIterator
 	Killer1            Move
 	Killer2            Move
+	ExcludedMove       Move
+	SelDepth           int
 	PrincipalVariation []Move
 	QuietsSearched     []Move
+	Stats              *SearchStats
+	counter            *nodeCounter
+	rootInTB           bool
 }
 
 type LimitsType struct {
@@ -108,19 +113,34 @@ type LimitsType struct {
 	Depth          int
 	Nodes          int
 	Mate           int
+	SearchMoves    []Move
 }
 
 type SearchParams struct {
 	Positions         []*Position
 	Limits            LimitsType
 	CancellationToken *CancellationToken
+	PonderToken       *PonderToken
 	Progress          func(si SearchInfo)
 }
 
-type SearchInfo struct {
+type SearchLine struct {
 	Score    int
-	Depth    int
-	Nodes    int64
-	Time     int64
 	MainLine []Move
 }
+
+type SearchInfo struct {
+	Score          int
+	Bound          int
+	Depth          int
+	SelDepth       int
+	Nodes          int64
+	Time           int64
+	HashFull       int
+	TBHits         int64
+	CurrMove       Move
+	CurrMoveNumber int
+	MainLine       []Move
+	Lines          []SearchLine
+	Stats          *SearchStats
+}
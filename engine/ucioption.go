@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UciOption is an engine parameter that the GUI can change with setoption.
+// Set parses the value, and the OnChange callback of the option,
+// if any, applies the new value to the engine immediately.
+type UciOption interface {
+	Name() string
+	Set(value string) error
+}
+
+type BoolUciOption struct {
+	name     string
+	Value    bool
+	OnChange func()
+}
+
+func (o *BoolUciOption) Name() string {
+	return o.name
+}
+
+func (o *BoolUciOption) Set(value string) error {
+	var v, err = strconv.ParseBool(value)
+	if err != nil {
+		return wrongOptionValue(o, value)
+	}
+	var changed = v != o.Value
+	o.Value = v
+	notifyChange(changed, o.OnChange)
+	return nil
+}
+
+type IntUciOption struct {
+	name            string
+	Value, Min, Max int
+	OnChange        func()
+}
+
+func (o *IntUciOption) Name() string {
+	return o.name
+}
+
+func (o *IntUciOption) Set(value string) error {
+	var v, err = strconv.Atoi(value)
+	if err != nil || v < o.Min || v > o.Max {
+		return wrongOptionValue(o, value)
+	}
+	var changed = v != o.Value
+	o.Value = v
+	notifyChange(changed, o.OnChange)
+	return nil
+}
+
+// StringUciOption is a free text, for example a file path.
+// The UCI value "<empty>" means the empty string.
+type StringUciOption struct {
+	name     string
+	Value    string
+	OnChange func()
+}
+
+func (o *StringUciOption) Name() string {
+	return o.name
+}
+
+func (o *StringUciOption) Set(value string) error {
+	if value == "<empty>" {
+		value = ""
+	}
+	var changed = value != o.Value
+	o.Value = value
+	notifyChange(changed, o.OnChange)
+	return nil
+}
+
+// ComboUciOption is one of the predefined values Vars.
+type ComboUciOption struct {
+	name     string
+	Value    string
+	Vars     []string
+	OnChange func()
+}
+
+func (o *ComboUciOption) Name() string {
+	return o.name
+}
+
+func (o *ComboUciOption) Set(value string) error {
+	for _, v := range o.Vars {
+		if strings.EqualFold(v, value) {
+			var changed = v != o.Value
+			o.Value = v
+			notifyChange(changed, o.OnChange)
+			return nil
+		}
+	}
+	return wrongOptionValue(o, value)
+}
+
+// ButtonUciOption has no value, setting it runs OnPress.
+type ButtonUciOption struct {
+	name    string
+	OnPress func()
+}
+
+func (o *ButtonUciOption) Name() string {
+	return o.name
+}
+
+func (o *ButtonUciOption) Set(value string) error {
+	if o.OnPress != nil {
+		o.OnPress()
+	}
+	return nil
+}
+
+func notifyChange(changed bool, onChange func()) {
+	if changed && onChange != nil {
+		onChange()
+	}
+}
+
+func wrongOptionValue(o UciOption, value string) error {
+	return fmt.Errorf("Wrong value %v of option %v", value, o.Name())
+}
@@ -88,12 +88,16 @@ func SquareName(sq int) string {
 	return string(file) + string(rank)
 }
 
+// ParseSquare returns SquareNone for "-" and for invalid square names.
 func ParseSquare(s string) int {
-	if s == "-" {
+	if len(s) != 2 {
 		return SquareNone
 	}
 	var file = strings.Index(fileNames, s[0:1])
 	var rank = strings.Index(rankNames, s[1:2])
+	if file < 0 || rank < 0 {
+		return SquareNone
+	}
 	return MakeSquare(file, rank)
 }
 
@@ -161,13 +165,23 @@ func (m Move) String() string {
 	return SquareName(m.From()) + SquareName(m.To()) + sPromotion
 }
 
+// ParseMove parses a move in coordinate notation. It returns MoveEmpty if s is malformed.
 func ParseMove(s string) Move {
 	s = strings.ToLower(s)
+	if len(s) != 4 && len(s) != 5 {
+		return MoveEmpty
+	}
 	var from = ParseSquare(s[0:2])
 	var to = ParseSquare(s[2:4])
-	if len(s) <= 4 {
+	if from == SquareNone || to == SquareNone {
+		return MoveEmpty
+	}
+	if len(s) == 4 {
 		return MakeMove(from, to, Empty, Empty)
 	}
-	var promotion = strings.Index("nbrqk", strings.ToLower(s[4:5])) + Knight
-	return MakePawnMove(from, to, Empty, promotion)
+	var promotion = strings.Index("nbrq", s[4:5])
+	if promotion < 0 {
+		return MoveEmpty
+	}
+	return MakePawnMove(from, to, Empty, promotion+Knight)
 }
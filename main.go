@@ -1,11 +1,13 @@
 package main
 
 import (
+	"os"
+
 	"github.com/ChizhovVadim/CounterGo/engine"
 	"github.com/ChizhovVadim/CounterGo/shell"
 )
 
 func main() {
-	var uci = shell.NewUciProtocol(engine.NewEngine())
+	var uci = shell.NewUciProtocol(engine.NewEngine(), os.Stdin, os.Stdout)
 	uci.Run()
 }
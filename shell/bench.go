@@ -0,0 +1,108 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ChizhovVadim/CounterGo/engine"
+)
+
+var benchFENs = []string{
+	engine.InitialPositionFen,
+	"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+	"r1bqk2r/pppp1ppp/2n2n2/8/1b1NP3/2N5/PPP2PPP/R1BQKB1R w KQkq - 3 6",
+	"r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+	"2rqkb1r/p1pnpppp/3p3n/3B4/2BPP3/1QP5/PP3PPP/RN2K1NR w KQk - 0 1",
+	"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+}
+
+type benchResult struct {
+	threads int
+	elapsed time.Duration
+	nodes   int64
+}
+
+// RunBench searches the bench positions to a fixed depth with 1, 2, 4 and 8 threads
+// and reports time-to-depth speedup and nps scaling relative to one thread.
+func RunBench(w io.Writer, depth int) {
+	var results []benchResult
+	for _, threads := range []int{1, 2, 4, 8} {
+		var result = benchThreads(threads, engine.LimitsType{Depth: depth})
+		results = append(results, result)
+		var nps = result.nodes * int64(time.Second) / int64(result.elapsed+1)
+		var baseNps = results[0].nodes * int64(time.Second) / int64(results[0].elapsed+1)
+		fmt.Fprintf(w, "threads %v time %v nodes %v nps %v speedup %.2f nps scaling %.2f\n",
+			result.threads, result.elapsed, result.nodes, nps,
+			float64(results[0].elapsed)/float64(result.elapsed+1),
+			float64(nps)/float64(baseNps+1))
+	}
+}
+
+// RunNpsBench searches each bench position for a fixed time with 1, 2, 4 and 8 threads
+// and reports nodes per second. Unlike RunBench it measures raw speed of parallel search,
+// not the time to reach a depth.
+func RunNpsBench(w io.Writer, moveTime int) {
+	var baseNps int64
+	for _, threads := range []int{1, 2, 4, 8} {
+		var result = benchThreads(threads, engine.LimitsType{MoveTime: moveTime})
+		var nps = result.nodes * int64(time.Second) / int64(result.elapsed+1)
+		if threads == 1 {
+			baseNps = nps
+		}
+		fmt.Fprintf(w, "threads %v nodes %v nps %v nps scaling %.2f\n",
+			threads, result.nodes, nps, float64(nps)/float64(baseNps+1))
+	}
+}
+
+// newBenchEngine returns an engine that forgets the previous position before each search.
+func newBenchEngine(threads int) *engine.Engine {
+	var uciEngine = engine.NewEngine()
+	uciEngine.Hash.Value = 64
+	uciEngine.Threads.Value = threads
+	uciEngine.ClearTransTable = true
+	uciEngine.Prepare()
+	return uciEngine
+}
+
+// benchThreads searches all bench positions with limits.
+func benchThreads(threads int, limits engine.LimitsType) benchResult {
+	var uciEngine = newBenchEngine(threads)
+	var result = benchResult{threads: threads}
+	for _, fen := range benchFENs {
+		var start = time.Now()
+		var searchResult = uciEngine.Search(engine.SearchParams{
+			Positions: []*engine.Position{engine.NewPositionFromFEN(fen)},
+			Limits:    limits,
+		})
+		result.elapsed += time.Since(start)
+		result.nodes += searchResult.Nodes
+	}
+	return result
+}
+
+// RunSearchStats searches the bench positions to a fixed depth with one thread
+// and prints search statistics summed over all positions.
+func RunSearchStats(w io.Writer, depth int) {
+	var uciEngine = newBenchEngine(1)
+	uciEngine.Statistics.Value = true
+	var total = &engine.SearchStats{}
+	for i, fen := range benchFENs {
+		var searchResult = uciEngine.Search(engine.SearchParams{
+			Positions: []*engine.Position{engine.NewPositionFromFEN(fen)},
+			Limits:    engine.LimitsType{Depth: depth},
+		})
+		var stats = searchResult.Stats
+		total.Add(stats)
+		for j, it := range stats.Iterations {
+			if i == 0 {
+				total.Iterations = append(total.Iterations, it)
+			} else if j < len(total.Iterations) && total.Iterations[j].Depth == it.Depth {
+				total.Iterations[j].Nodes += it.Nodes
+			}
+		}
+	}
+	for _, s := range total.Lines() {
+		fmt.Fprintln(w, s)
+	}
+}
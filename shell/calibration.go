@@ -0,0 +1,105 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ChizhovVadim/CounterGo/engine"
+)
+
+const (
+	calibrationEloStep  = 200
+	calibrationMoveTime = 50
+	calibrationMaxPlies = 300
+)
+
+func newLimitedEngine(elo int, seed int64) *engine.Engine {
+	var result = engine.NewEngine()
+	result.Hash.Value = 16
+	result.Threads.Value = 1
+	result.LimitStrength.Value = true
+	result.Elo.Value = elo
+	result.RandomSeed = seed
+	result.Prepare()
+	return result
+}
+
+// RunCalibration plays matches between neighbour UCI_Elo settings
+// and prints the Elo curve measured from the match scores,
+// anchored at the lowest setting.
+func RunCalibration(w io.Writer, gamesPerMatch int) {
+	var measured = float64(engine.MinElo)
+	fmt.Fprintf(w, "elo %v level %v measured %.0f\n",
+		engine.MinElo, engine.EloToSkillLevel(engine.MinElo), measured)
+	for elo := engine.MinElo + calibrationEloStep; elo <= engine.MaxElo; elo += calibrationEloStep {
+		var weak = newLimitedEngine(elo-calibrationEloStep, int64(elo))
+		var strong = newLimitedEngine(elo, int64(elo)+1)
+		var score = playMatch(strong, weak, gamesPerMatch)
+		measured += eloDifference(score)
+		fmt.Fprintf(w, "elo %v level %v measured %.0f score %.3f\n",
+			elo, engine.EloToSkillLevel(elo), measured, score)
+	}
+}
+
+// playMatch returns the score of engine1 from 0 to 1.
+func playMatch(engine1, engine2 UciEngine, games int) float64 {
+	var points = 0.0
+	for i := 0; i < games; i++ {
+		var pos = engine.NewPositionFromFEN(openings[(i/2)%len(openings)])
+		var engine1White = i%2 == 0
+		var white, black = engine1, engine2
+		if !engine1White {
+			white, black = engine2, engine1
+		}
+		switch playQuickGame(white, black, pos) {
+		case GameResultWhiteWins:
+			if engine1White {
+				points++
+			}
+		case GameResultBlackWins:
+			if !engine1White {
+				points++
+			}
+		default:
+			points += 0.5
+		}
+	}
+	return points / float64(games)
+}
+
+// playQuickGame plays a game with a fixed time per move.
+// Games longer than calibrationMaxPlies are adjudicated as draws.
+func playQuickGame(white, black UciEngine, initialPosition *engine.Position) int {
+	white.NewGame()
+	black.NewGame()
+	var positions = []*engine.Position{initialPosition}
+	for ply := 0; ply < calibrationMaxPlies; ply++ {
+		var gameResult = ComputeGameResult(positions)
+		if gameResult != GameResultNone {
+			return gameResult
+		}
+		var uciEngine = black
+		if positions[len(positions)-1].WhiteMove {
+			uciEngine = white
+		}
+		var searchResult = uciEngine.Search(engine.SearchParams{
+			Positions: positions,
+			Limits:    engine.LimitsType{MoveTime: calibrationMoveTime},
+		})
+		if len(searchResult.MainLine) == 0 {
+			panic("engine returned no move")
+		}
+		var newPos = &engine.Position{}
+		if !positions[len(positions)-1].MakeMove(searchResult.MainLine[0], newPos) {
+			panic("engine illegal move")
+		}
+		positions = append(positions, newPos)
+	}
+	return GameResultDraw
+}
+
+func eloDifference(score float64) float64 {
+	score = math.Max(0.01, math.Min(0.99, score))
+	return -400 * math.Log10(1/score-1)
+}
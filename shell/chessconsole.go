@@ -2,6 +2,7 @@ package shell
 
 import (
 	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/ChizhovVadim/CounterGo/engine"
@@ -55,13 +56,13 @@ var chessSymbols = [2][7]string{
 	{" ", blackPawn, blackKnight, blackBishop, blackRook, blackQueen, blackKing},
 }
 
-func PrintPosition(p *engine.Position) {
+func PrintPosition(w io.Writer, p *engine.Position) {
 	for i := 0; i < 64; i++ {
 		sq := engine.FlipSquare(i)
 		piece, side := p.GetPieceTypeAndSide(sq)
-		fmt.Print(PieceString(piece, side, engine.IsDarkSquare(sq)))
+		fmt.Fprint(w, PieceString(piece, side, engine.IsDarkSquare(sq)))
 		if engine.File(sq) == engine.FileH {
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 	}
 }
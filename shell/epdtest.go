@@ -3,6 +3,7 @@ package shell
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -16,10 +17,14 @@ type TestItem struct {
 	BestMoves []engine.Move
 }
 
-func RunEpdTest(filePath string, uciEngine UciEngine) {
-	var epdTests = LoadEpdTests(filePath)
-	fmt.Printf("Loaded %v tests\n", len(epdTests))
-	fmt.Println("Test started...")
+func RunEpdTest(w io.Writer, filePath string, uciEngine UciEngine) {
+	var epdTests, err = LoadEpdTests(filePath)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Loaded %v tests\n", len(epdTests))
+	fmt.Fprintln(w, "Test started...")
 	var start = time.Now()
 	var total, solved int
 	for _, test := range epdTests {
@@ -42,24 +47,21 @@ func RunEpdTest(filePath string, uciEngine UciEngine) {
 			solved++
 		}
 
-		fmt.Println(test.Content)
-		fmt.Println(searchResult.String())
-		fmt.Printf("Solved: %v, Total: %v\n", solved, total)
-		fmt.Println()
+		fmt.Fprintln(w, test.Content)
+		fmt.Fprintln(w, searchResult.String())
+		fmt.Fprintf(w, "Solved: %v, Total: %v\n", solved, total)
+		fmt.Fprintln(w)
 	}
-	fmt.Printf("Test finished. Elapsed: %v\n", time.Since(start))
+	fmt.Fprintf(w, "Test finished. Elapsed: %v\n", time.Since(start))
 }
 
-func LoadEpdTests(filePath string) (result []*TestItem) {
-	var err = ProcessFileByLines(filePath, func(line string) {
+func LoadEpdTests(filePath string) (result []*TestItem, err error) {
+	err = ProcessFileByLines(filePath, func(line string) {
 		var test = ParseEpdTest(line)
 		if test != nil {
 			result = append(result, test)
 		}
 	})
-	if err != nil {
-		fmt.Println(err)
-	}
 	return
 }
 
@@ -2,6 +2,8 @@ package shell
 
 import (
 	"fmt"
+	"io"
+	"math/rand"
 	"time"
 
 	"github.com/ChizhovVadim/CounterGo/engine"
@@ -27,6 +29,17 @@ func NewEngineB() UciEngine {
 	return result
 }
 
+// NewContemptEngine returns an engine that differs from NewEngineA only by contempt.
+func NewContemptEngine(contempt int) UciEngine {
+	var result = engine.NewEngine()
+	result.Hash.Value = 16
+	result.Threads.Value = 1
+	result.Contempt.Value = contempt
+	result.ClearTransTable = true
+	result.Prepare()
+	return result
+}
+
 const (
 	GameResultNone = iota
 	GameResultWhiteWins
@@ -42,16 +55,41 @@ var openings = []string{
 	"rnbqkb1r/pp2pppp/2p2n2/3p4/2PP4/5N2/PP2PPPP/RNBQKB1R w KQkq - 2 4",
 }
 
-func RunTournament() {
-	fmt.Println("Tournament started...")
+// BookOpenings follows random lines of book for up to plies half moves
+// and returns at most count distinct positions where the lines end.
+func BookOpenings(book *engine.Book, count, plies int, seed int64) []string {
+	var r = rand.New(rand.NewSource(seed))
+	var seen = make(map[string]bool)
+	var result []string
+	for attempt := 0; attempt < 10*count && len(result) < count; attempt++ {
+		var pos = engine.NewPositionFromFEN(engine.InitialPositionFen)
+		for i := 0; i < plies; i++ {
+			var move = book.PickMove(pos, 100, r)
+			if move == engine.MoveEmpty {
+				break
+			}
+			pos = pos.MakeMoveIfLegal(move)
+		}
+		var fen = pos.String()
+		if !seen[fen] {
+			seen[fen] = true
+			result = append(result, fen)
+		}
+	}
+	return result
+}
+
+// RunTournament plays every opening twice, the engines swap colors.
+func RunTournament(w io.Writer, engine1, engine2 UciEngine, openings []string) {
+	fmt.Fprintln(w, "Tournament started...")
 	var numberOfGames = len(openings) * 2
 	var playedGames = 0
 	var engines = []struct {
 		engine UciEngine
 		wins   int
 	}{
-		{NewEngineA(), 0},
-		{NewEngineB(), 0},
+		{engine1, 0},
+		{engine2, 0},
 	}
 	for i := 0; i < numberOfGames; i++ {
 		var opening = openings[(i/2)%len(openings)]
@@ -59,7 +97,7 @@ func RunTournament() {
 
 		var whiteEngineIndex = i % 2
 		var blackEngineIndex = whiteEngineIndex ^ 1
-		var res = PlayGame(engines[whiteEngineIndex].engine,
+		var res = PlayGame(w, engines[whiteEngineIndex].engine,
 			engines[blackEngineIndex].engine, pos)
 		playedGames++
 		if res == GameResultWhiteWins {
@@ -68,13 +106,13 @@ func RunTournament() {
 			engines[blackEngineIndex].wins++
 		}
 
-		fmt.Printf("Engine1: %v Engine2: %v Total games: %v\n",
+		fmt.Fprintf(w, "Engine1: %v Engine2: %v Total games: %v\n",
 			engines[0].wins, engines[1].wins, playedGames)
 	}
-	fmt.Println("Tournament finished.")
+	fmt.Fprintln(w, "Tournament finished.")
 }
 
-func PlayGame(engine1, engine2 UciEngine, initialPosition *engine.Position) int {
+func PlayGame(w io.Writer, engine1, engine2 UciEngine, initialPosition *engine.Position) int {
 	var positions = []*engine.Position{initialPosition}
 	var gameTime, isNodeLimits = 2 * 60 * 1000, false
 	//var gameTime, isNodeLimits = 100 * 1000 * 1000, true
@@ -118,8 +156,8 @@ func PlayGame(engine1, engine2 UciEngine, initialPosition *engine.Position) int
 				return GameResultWhiteWins
 			}
 		}
-		fmt.Println(searchResult.String())
-		fmt.Printf("White: %v Black: %v\n", limits.WhiteTime, limits.BlackTime)
+		fmt.Fprintln(w, searchResult.String())
+		fmt.Fprintf(w, "White: %v Black: %v\n", limits.WhiteTime, limits.BlackTime)
 		var move = searchResult.MainLine[0]
 		var newPos = &engine.Position{}
 		var ok = positions[len(positions)-1].MakeMove(move, newPos)
@@ -127,8 +165,8 @@ func PlayGame(engine1, engine2 UciEngine, initialPosition *engine.Position) int
 			panic("engine illegal move")
 		}
 		positions = append(positions, newPos)
-		fmt.Println(newPos)
-		PrintPosition(newPos)
+		fmt.Fprintln(w, newPos)
+		PrintPosition(w, newPos)
 	}
 }
 
@@ -3,9 +3,10 @@ package shell
 import (
 	"bufio"
 	"fmt"
-	"os"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ChizhovVadim/CounterGo/engine"
@@ -15,38 +16,214 @@ type UciEngine interface {
 	GetInfo() (name, version, author string)
 	GetOptions() []engine.UciOption
 	Prepare()
+	NewGame()
 	Search(searchParams engine.SearchParams) engine.SearchInfo
 }
 
+// hashStorage is implemented by engines that can keep the transposition table in a file.
+type hashStorage interface {
+	SaveHash() error
+	LoadHash() error
+}
+
+// tablebaseInfo is implemented by engines that probe endgame tablebases.
+type tablebaseInfo interface {
+	TablebasesInfo() string
+}
+
+// endgameTableInfo is implemented by engines that probe the built-in endgame tables.
+type endgameTableInfo interface {
+	EndgameTablesInfo() string
+}
+
+// openingBook is implemented by engines that play from a Polyglot book.
+type openingBook interface {
+	BookInfo() string
+	BookEntries(p *engine.Position) ([]engine.BookEntry, error)
+}
+
 type commandHandler func(uci *UciProtocol, args []string)
 
 type UciProtocol struct {
-	commands  map[string]commandHandler
-	engine    UciEngine
-	positions []*engine.Position
-	ct        *engine.CancellationToken
+	commands map[string]commandHandler
+	// searchCommands may run during a search, other commands wait until
+	// the search has reported bestmove. Ponder and infinite searches are stopped first.
+	searchCommands map[string]bool
+	engine         UciEngine
+	positions      []*engine.Position
+	session        searchSession
+	input          io.Reader
+	output         io.Writer
+}
+
+// lockedWriter serialises lines written by the command goroutine and the search goroutine.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+type sessionState int
+
+const (
+	sessionIdle sessionState = iota
+	sessionSearching
+	sessionPondering
+)
+
+// searchSession runs at most one search at a time. Commands are handled by the
+// goroutine reading input, the search runs in its own goroutine and reports
+// bestmove exactly once per go before the session becomes idle again.
+type searchSession struct {
+	mu    sync.Mutex
+	state sessionState
+	ct    *engine.CancellationToken
+	pt    *engine.PonderToken
+	done  chan struct{}
+	// infinite is true if the search ends only on stop.
+	infinite bool
+}
+
+// Start launches search in a new goroutine. It returns false if a search is running.
+// A panic of search is passed to failed, so that the GUI still gets bestmove.
+func (s *searchSession) Start(searchParams engine.SearchParams,
+	search func(searchParams engine.SearchParams), failed func(r interface{})) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != sessionIdle {
+		return false
+	}
+	s.ct = &engine.CancellationToken{}
+	s.pt = &engine.PonderToken{}
+	s.done = make(chan struct{})
+	s.state = sessionSearching
+	s.infinite = searchParams.Limits.Infinite
+	if searchParams.Limits.Ponder {
+		s.state = sessionPondering
+	}
+	searchParams.CancellationToken = s.ct
+	searchParams.PonderToken = s.pt
+	var done = s.done
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				failed(r)
+			}
+			s.mu.Lock()
+			s.state = sessionIdle
+			s.mu.Unlock()
+		}()
+		search(searchParams)
+	}()
+	return true
+}
+
+// Finish blocks until the running search has reported bestmove. A finite search
+// completes, a ponder or infinite search is cancelled, because it ends only on stop.
+func (s *searchSession) Finish() {
+	s.mu.Lock()
+	if s.state == sessionIdle {
+		s.mu.Unlock()
+		return
+	}
+	if s.infinite || s.state == sessionPondering {
+		s.ct.Cancel()
+	}
+	var done = s.done
+	s.mu.Unlock()
+	<-done
+}
+
+// Stop cancels the running search and waits until it has reported bestmove.
+func (s *searchSession) Stop() {
+	s.mu.Lock()
+	if s.state == sessionIdle {
+		s.mu.Unlock()
+		return
+	}
+	s.ct.Cancel()
+	var done = s.done
+	s.mu.Unlock()
+	<-done
+}
+
+// PonderHit turns a ponder search into a normal search.
+func (s *searchSession) PonderHit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == sessionPondering {
+		s.state = sessionSearching
+		s.pt.PonderHit()
+	}
+}
+
+func (s *searchSession) State() sessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
 }
 
 func UciCommand(uci *UciProtocol, args []string) {
 	var name, version, author = uci.engine.GetInfo()
-	fmt.Printf("id name %s %s\n", name, version)
-	fmt.Printf("id author %s\n", author)
+	fmt.Fprintf(uci.output, "id name %s %s\n", name, version)
+	fmt.Fprintf(uci.output, "id author %s\n", author)
 	uci.PrintOptions()
-	fmt.Println("uciok")
+	fmt.Fprintln(uci.output, "uciok")
 }
 
+// SetOptionCommand handles "setoption name <id> [value <x>]", id may contain spaces.
 func SetOptionCommand(uci *UciProtocol, args []string) {
-	if len(args) >= 4 {
-		uci.SetOption(args[1], args[3])
+	var nameIndex = findIndexString(args, "name")
+	if nameIndex == -1 {
+		uci.DebugUci("Wrong setoption command")
+		return
+	}
+	var valueIndex = findIndexString(args, "value")
+	var name, value string
+	if valueIndex == -1 {
+		name = strings.Join(args[nameIndex+1:], " ")
+	} else if valueIndex > nameIndex {
+		name = strings.Join(args[nameIndex+1:valueIndex], " ")
+		value = strings.Join(args[valueIndex+1:], " ")
+	}
+	if name == "" {
+		uci.DebugUci("Wrong setoption command")
+		return
+	}
+	if err := uci.SetOption(name, value); err != nil {
+		uci.DebugUci(err.Error())
+		return
+	}
+	if tb, ok := uci.engine.(tablebaseInfo); ok && strings.EqualFold(name, "SyzygyPath") {
+		uci.DebugUci(tb.TablebasesInfo())
+	}
+	if tb, ok := uci.engine.(endgameTableInfo); ok && strings.EqualFold(name, "EgtbPath") {
+		uci.DebugUci(tb.EndgameTablesInfo())
+	}
+	if book, ok := uci.engine.(openingBook); ok && strings.EqualFold(name, "Book File") {
+		uci.DebugUci(book.BookInfo())
 	}
 }
 
+// IsReadyCommand answers immediately, also during a search.
 func IsReadyCommand(uci *UciProtocol, args []string) {
-	uci.engine.Prepare()
-	fmt.Println("readyok")
+	if uci.session.State() == sessionIdle {
+		uci.engine.Prepare()
+	}
+	fmt.Fprintln(uci.output, "readyok")
 }
 
 func PositionCommand(uci *UciProtocol, args []string) {
+	if len(args) == 0 {
+		uci.DebugUci("Wrong position command")
+		return
+	}
 	var token = args[0]
 	var fen string
 	var movesIndex = findIndexString(args, "moves")
@@ -59,12 +236,12 @@ func PositionCommand(uci *UciProtocol, args []string) {
 			fen = strings.Join(args[1:movesIndex], " ")
 		}
 	} else {
-		DebugUci("Wrong position command")
+		uci.DebugUci("Wrong position command")
 		return
 	}
 	var p = engine.NewPositionFromFEN(fen)
 	if p == nil {
-		DebugUci("Wrong fen")
+		uci.DebugUci("Wrong fen")
 		return
 	}
 	var positions = []*engine.Position{p}
@@ -73,7 +250,7 @@ func PositionCommand(uci *UciProtocol, args []string) {
 			var move = engine.ParseMove(smove)
 			var newPos = positions[len(positions)-1].MakeMoveIfLegal(move)
 			if newPos == nil {
-				DebugUci("Wrong move")
+				uci.DebugUci("Wrong move")
 				return
 			} else {
 				positions = append(positions, newPos)
@@ -93,71 +270,130 @@ func findIndexString(slice []string, value string) int {
 }
 
 func GoCommand(uci *UciProtocol, args []string) {
-	var limits = ParseLimits(args)
+	var limits, err = ParseLimits(args)
+	if err != nil {
+		uci.DebugUci(err.Error())
+		return
+	}
 	var searchParams = engine.SearchParams{
-		Positions:         uci.positions,
-		Limits:            limits,
-		CancellationToken: &engine.CancellationToken{},
-		Progress:          engine.SendProgressToUci,
+		Positions: uci.positions,
+		Limits:    limits,
+		Progress:  uci.SendProgress,
 	}
-	go func() {
-		uci.ct = searchParams.CancellationToken
+	var started = uci.session.Start(searchParams, func(searchParams engine.SearchParams) {
 		var searchResult = uci.engine.Search(searchParams)
-		engine.SendResultToUci(searchResult)
-	}()
+		uci.SendResult(searchResult)
+	}, func(r interface{}) {
+		uci.DebugUci(fmt.Sprint("Search failed: ", r))
+		uci.SendResult(engine.SearchInfo{})
+	})
+	if !started {
+		uci.DebugUci("Search is running")
+	}
+}
+
+func (uci *UciProtocol) SendProgress(si engine.SearchInfo) {
+	if si.Time >= 500 || si.Depth >= 5 || len(si.MainLine) == 0 {
+		for _, s := range si.MultiPVStrings() {
+			fmt.Fprintln(uci.output, s)
+		}
+	}
+}
+
+func (uci *UciProtocol) SendResult(si engine.SearchInfo) {
+	for _, s := range si.MultiPVStrings() {
+		fmt.Fprintln(uci.output, s)
+	}
+	if si.Stats != nil {
+		for _, s := range si.Stats.Lines() {
+			uci.DebugUci(s)
+		}
+	}
+	if len(si.MainLine) >= 2 {
+		fmt.Fprintf(uci.output, "bestmove %v ponder %v\n", si.MainLine[0], si.MainLine[1])
+	} else if len(si.MainLine) > 0 {
+		fmt.Fprintf(uci.output, "bestmove %v\n", si.MainLine[0])
+	} else {
+		// No legal moves, the GUI still expects an answer.
+		fmt.Fprintln(uci.output, "bestmove 0000")
+	}
 }
 
-func ParseLimits(args []string) (result engine.LimitsType) {
+// ParseLimits parses the arguments of the go command.
+func ParseLimits(args []string) (result engine.LimitsType, err error) {
 	for i := 0; i < len(args); i++ {
+		var value *int
 		switch args[i] {
 		case "ponder":
 			result.Ponder = true
 		case "wtime":
-			result.WhiteTime, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.WhiteTime
 		case "btime":
-			result.BlackTime, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.BlackTime
 		case "winc":
-			result.WhiteIncrement, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.WhiteIncrement
 		case "binc":
-			result.BlackIncrement, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.BlackIncrement
 		case "movestogo":
-			result.MovesToGo, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.MovesToGo
 		case "depth":
-			result.Depth, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.Depth
 		case "nodes":
-			result.Nodes, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.Nodes
 		case "mate":
-			result.Mate, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.Mate
 		case "movetime":
-			result.MoveTime, _ = strconv.Atoi(args[i+1])
-			i++
+			value = &result.MoveTime
 		case "infinite":
 			result.Infinite = true
+		case "searchmoves":
+			for i+1 < len(args) && !isGoKeyword(args[i+1]) {
+				var move = engine.ParseMove(args[i+1])
+				if move == engine.MoveEmpty {
+					return result, fmt.Errorf("Wrong searchmoves move %v", args[i+1])
+				}
+				result.SearchMoves = append(result.SearchMoves, move)
+				i++
+			}
+		default:
+			return result, fmt.Errorf("Unknown go parameter %v", args[i])
+		}
+		if value != nil {
+			if i+1 >= len(args) {
+				return result, fmt.Errorf("Missing value of go parameter %v", args[i])
+			}
+			var v, convErr = strconv.Atoi(args[i+1])
+			if convErr != nil {
+				return result, fmt.Errorf("Wrong value of go parameter %v", args[i])
+			}
+			// Time may be negative if the GUI is late, the engine then moves at once.
+			if v < 0 && args[i] != "wtime" && args[i] != "btime" {
+				return result, fmt.Errorf("Wrong value of go parameter %v", args[i])
+			}
+			*value = v
+			i++
 		}
 	}
 	return
 }
 
-func UciNewGameCommand(uci *UciProtocol, args []string) {
+var goKeywords = []string{"ponder", "wtime", "btime", "winc", "binc", "movestogo",
+	"depth", "nodes", "mate", "movetime", "infinite", "searchmoves"}
 
+func isGoKeyword(s string) bool {
+	return findIndexString(goKeywords, s) != -1
 }
 
-func PonderhitCommand(uci *UciProtocol, args []string) {
+func UciNewGameCommand(uci *UciProtocol, args []string) {
+	uci.engine.NewGame()
+}
 
+func PonderhitCommand(uci *UciProtocol, args []string) {
+	uci.session.PonderHit()
 }
 
 func StopCommand(uci *UciProtocol, args []string) {
-	if uci.ct != nil {
-		uci.ct.Cancel()
-	}
+	uci.session.Stop()
 }
 
 func BenchmarkCommand(uci *UciProtocol, args []string) {
@@ -170,23 +406,67 @@ func BenchmarkCommand(uci *UciProtocol, args []string) {
 		i += len(engine.GenerateMoves(p, ml))
 	}
 	var elapsed = time.Since(start)
-	fmt.Println(ml)
-	fmt.Println(elapsed)
+	fmt.Fprintln(uci.output, ml)
+	fmt.Fprintln(uci.output, elapsed)
+}
+
+// BenchCommand runs "bench [depth]" or "bench nps [movetime]".
+func BenchCommand(uci *UciProtocol, args []string) {
+	if len(args) > 0 && args[0] == "nps" {
+		var moveTime, ok = uci.positiveArg(args[1:], 1000)
+		if ok {
+			RunNpsBench(uci.output, moveTime)
+		}
+		return
+	}
+	var depth, ok = uci.positiveArg(args, 10)
+	if ok {
+		RunBench(uci.output, depth)
+	}
+}
+
+func StatsCommand(uci *UciProtocol, args []string) {
+	var depth, ok = uci.positiveArg(args, 10)
+	if ok {
+		RunSearchStats(uci.output, depth)
+	}
+}
+
+// positiveArg parses the optional first argument of a command.
+// It reports a wrong argument and returns false.
+func (uci *UciProtocol) positiveArg(args []string, defaultValue int) (int, bool) {
+	if len(args) == 0 {
+		return defaultValue, true
+	}
+	var v, err = strconv.Atoi(args[0])
+	if err != nil || v <= 0 {
+		uci.DebugUci("Wrong argument " + args[0])
+		return 0, false
+	}
+	return v, true
 }
 
 func EvalCommand(uci *UciProtocol, args []string) {
 	var p = uci.positions[len(uci.positions)-1]
 	var e = engine.NewEvaluation(false)
-	e.Trace()
+	var trace strings.Builder
+	e.Trace(&trace)
+	for _, line := range strings.Split(strings.TrimSpace(trace.String()), "\n") {
+		uci.DebugUci(line)
+	}
 	var score = e.Evaluate(p)
-	fmt.Printf("score %v\n", score)
+	fmt.Fprintf(uci.output, "score %v\n", score)
 }
 
 func MoveCommand(uci *UciProtocol, args []string) {
+	if len(args) == 0 {
+		uci.DebugUci("Wrong move command")
+		return
+	}
 	var move = engine.ParseMove(args[0])
 	var newPos = uci.positions[len(uci.positions)-1].MakeMoveIfLegal(move)
 	if newPos == nil {
-		DebugUci("Wrong move")
+		uci.DebugUci("Wrong move")
 		return
 	}
 	uci.positions = append(uci.positions, newPos)
@@ -196,15 +476,19 @@ func MoveCommand(uci *UciProtocol, args []string) {
 	var searchParams = engine.SearchParams{
 		Positions: uci.positions,
 		Limits:    limits,
-		Progress:  engine.SendProgressToUci,
+		Progress:  uci.SendProgress,
 	}
 	var searchResult = uci.engine.Search(searchParams)
-	engine.SendResultToUci(searchResult)
+	uci.SendResult(searchResult)
+	if len(searchResult.MainLine) == 0 {
+		PrintPosition(uci.output, newPos)
+		return
+	}
 	newPos = newPos.MakeMoveIfLegal(searchResult.MainLine[0])
 	if newPos != nil {
 		uci.positions = append(uci.positions, newPos)
-		PrintPosition(newPos)
-		fmt.Println(newPos)
+		PrintPosition(uci.output, newPos)
+		fmt.Fprintln(uci.output, newPos)
 	}
 }
 
@@ -213,11 +497,145 @@ func EpdCommand(uci *UciProtocol, args []string) {
 	if len(args) > 0 {
 		filePath = args[0]
 	}
-	RunEpdTest(filePath, uci.engine)
+	RunEpdTest(uci.output, filePath, uci.engine)
 }
 
+// Number of openings and their length in half moves for "arena book".
+const (
+	arenaBookOpenings = 20
+	arenaBookPlies    = 12
+)
+
+// ArenaCommand plays the baseline engine against the experiment engine,
+// or against an engine with contempt: "arena contempt [cp]".
+// With "book <file>" the openings are random lines of a Polyglot book.
 func ArenaCommand(uci *UciProtocol, args []string) {
-	RunTournament()
+	var tournamentOpenings = openings
+	if i := findIndexString(args, "book"); i != -1 {
+		if i+1 >= len(args) {
+			uci.DebugUci("Wrong arguments, expected book file")
+			return
+		}
+		var book, err = engine.OpenBook(args[i+1])
+		if err != nil {
+			uci.DebugUci(err.Error())
+			return
+		}
+		tournamentOpenings = BookOpenings(book, arenaBookOpenings, arenaBookPlies, time.Now().UnixNano())
+		args = append(args[:i:i], args[i+2:]...)
+	}
+	if len(args) > 0 && args[0] == "contempt" {
+		var contempt = 20
+		if len(args) > 1 {
+			var v, err = strconv.Atoi(args[1])
+			if err != nil {
+				uci.DebugUci("Wrong argument " + args[1])
+				return
+			}
+			contempt = v
+		}
+		RunTournament(uci.output, NewEngineA(), NewContemptEngine(contempt), tournamentOpenings)
+		return
+	}
+	if len(args) > 0 {
+		uci.DebugUci("Unknown arena mode " + args[0])
+		return
+	}
+	RunTournament(uci.output, NewEngineA(), NewEngineB(), tournamentOpenings)
+}
+
+func CalibrateCommand(uci *UciProtocol, args []string) {
+	var games, ok = uci.positiveArg(args, 20)
+	if ok {
+		RunCalibration(uci.output, games)
+	}
+}
+
+// SaveCommand handles "save hash".
+func SaveCommand(uci *UciProtocol, args []string) {
+	uci.hashCommand(args, hashStorage.SaveHash, "Hash saved")
+}
+
+// LoadCommand handles "load hash".
+func LoadCommand(uci *UciProtocol, args []string) {
+	uci.hashCommand(args, hashStorage.LoadHash, "Hash loaded")
+}
+
+func (uci *UciProtocol) hashCommand(args []string, action func(hashStorage) error, done string) {
+	if len(args) != 1 || args[0] != "hash" {
+		uci.DebugUci("Wrong arguments, expected hash")
+		return
+	}
+	var storage, ok = uci.engine.(hashStorage)
+	if !ok {
+		uci.DebugUci("Engine has no hash storage")
+		return
+	}
+	if err := action(storage); err != nil {
+		uci.DebugUci(err.Error())
+		return
+	}
+	uci.DebugUci(done)
+}
+
+// EgtbCommand handles "egtb <dir> [pieces | names]". It builds the endgame tables
+// named like KQKR, or all tables with up to pieces pieces, by default three.
+func EgtbCommand(uci *UciProtocol, args []string) {
+	if len(args) == 0 {
+		uci.DebugUci("Wrong arguments, expected directory")
+		return
+	}
+	var names = args[1:]
+	if len(names) <= 1 {
+		if pieces, err := strconv.Atoi(strings.Join(names, "")); len(names) == 0 || err == nil {
+			if len(names) == 0 {
+				pieces = 3
+			}
+			names = engine.EndgameTableNames(pieces)
+		}
+	}
+	if err := engine.BuildEndgameTables(args[0], names, uci.output); err != nil {
+		uci.DebugUci(err.Error())
+		return
+	}
+	uci.DebugUci("Endgame tables built")
+}
+
+// BookCommand handles "book [file]". It prints the book moves of the current position
+// from file, or from the book of the Book File option.
+func BookCommand(uci *UciProtocol, args []string) {
+	var p = uci.positions[len(uci.positions)-1]
+	var entries []engine.BookEntry
+	var err error
+	if len(args) > 0 {
+		var book *engine.Book
+		book, err = engine.OpenBook(strings.Join(args, " "))
+		if err == nil {
+			entries = book.Entries(p)
+		}
+	} else if book, ok := uci.engine.(openingBook); ok {
+		entries, err = book.BookEntries(p)
+	} else {
+		uci.DebugUci("Engine has no opening book")
+		return
+	}
+	if err != nil {
+		uci.DebugUci(err.Error())
+		return
+	}
+	var total = 0
+	for _, entry := range entries {
+		total += entry.Weight
+	}
+	fmt.Fprintf(uci.output, "key %016x moves %v\n", engine.PolyglotKey(p), len(entries))
+	for _, entry := range entries {
+		var percent = 0.0
+		if total != 0 {
+			percent = 100 * float64(entry.Weight) / float64(total)
+		}
+		fmt.Fprintf(uci.output, "%v weight %v %.1f%% learn %v\n",
+			entry.Move, entry.Weight, percent, entry.Learn)
+	}
 }
 
 func StatusCommand(uci *UciProtocol, args []string) {
@@ -228,37 +646,44 @@ func (uci *UciProtocol) PrintOptions() {
 	for _, option := range uci.engine.GetOptions() {
 		switch o := option.(type) {
 		case *engine.BoolUciOption:
-			fmt.Printf("option name %v type %v default %v\n",
+			fmt.Fprintf(uci.output, "option name %v type %v default %v\n",
 				o.Name(), "check", o.Value)
 		case *engine.IntUciOption:
-			fmt.Printf("option name %v type %v default %v min %v max %v\n",
+			fmt.Fprintf(uci.output, "option name %v type %v default %v min %v max %v\n",
 				o.Name(), "spin", o.Value, o.Min, o.Max)
+		case *engine.StringUciOption:
+			var value = o.Value
+			if value == "" {
+				value = "<empty>"
+			}
+			fmt.Fprintf(uci.output, "option name %v type %v default %v\n",
+				o.Name(), "string", value)
+		case *engine.ComboUciOption:
+			fmt.Fprintf(uci.output, "option name %v type %v default %v var %v\n",
+				o.Name(), "combo", o.Value, strings.Join(o.Vars, " var "))
+		case *engine.ButtonUciOption:
+			fmt.Fprintf(uci.output, "option name %v type %v\n",
+				o.Name(), "button")
 		}
 	}
 }
 
-func (uci *UciProtocol) SetOption(name, value string) {
+func (uci *UciProtocol) SetOption(name, value string) error {
 	for _, option := range uci.engine.GetOptions() {
 		if strings.EqualFold(option.Name(), name) {
-			switch o := option.(type) {
-			case *engine.BoolUciOption:
-				if v, err := strconv.ParseBool(value); err == nil {
-					o.Value = v
-				}
-			case *engine.IntUciOption:
-				if v, err := strconv.Atoi(value); err == nil &&
-					o.Min <= v && v <= o.Max {
-					o.Value = v
-				}
-			}
-			return
+			return option.Set(value)
 		}
 	}
+	return fmt.Errorf("Unknown option %v", name)
 }
 
-func NewUciProtocol(uciEngine UciEngine) *UciProtocol {
+// NewUciProtocol creates a protocol that reads commands from input
+// and writes all responses of the engine to output.
+func NewUciProtocol(uciEngine UciEngine, input io.Reader, output io.Writer) *UciProtocol {
 	var uci = &UciProtocol{}
 	uci.engine = uciEngine
+	uci.input = input
+	uci.output = &lockedWriter{w: output}
 	uci.commands = map[string]commandHandler{
 		// UCI commands
 		"uci":        UciCommand,
@@ -272,12 +697,25 @@ func NewUciProtocol(uciEngine UciEngine) *UciProtocol {
 
 		// My commands
 		"benchmark": BenchmarkCommand,
+		"bench":     BenchCommand,
+		"stats":     StatsCommand,
 		"eval":      EvalCommand,
 		"move":      MoveCommand,
 		"epd":       EpdCommand,
 		"arena":     ArenaCommand,
+		"calibrate": CalibrateCommand,
+		"save":      SaveCommand,
+		"load":      LoadCommand,
+		"egtb":      EgtbCommand,
+		"book":      BookCommand,
 		"status":    StatusCommand,
 	}
+	uci.searchCommands = map[string]bool{
+		"isready":   true,
+		"position":  true,
+		"ponderhit": true,
+		"stop":      true,
+	}
 	var p = engine.NewPositionFromFEN(engine.InitialPositionFen)
 	uci.positions = []*engine.Position{p}
 	return uci
@@ -285,24 +723,40 @@ func NewUciProtocol(uciEngine UciEngine) *UciProtocol {
 
 func (uci *UciProtocol) Run() {
 	var name, version, _ = uci.engine.GetInfo()
-	fmt.Printf("%v %v\n", name, version)
-	var scanner = bufio.NewScanner(os.Stdin)
+	fmt.Fprintf(uci.output, "%v %v\n", name, version)
+	var scanner = bufio.NewScanner(uci.input)
+	defer uci.session.Stop()
 	for scanner.Scan() {
-		var commandLine = scanner.Text()
-		if commandLine == "quit" {
-			return
+		var cmdArgs = strings.Fields(scanner.Text())
+		if len(cmdArgs) == 0 {
+			continue
 		}
-		var cmdArgs = strings.Fields(commandLine)
 		var commandName = cmdArgs[0]
+		if commandName == "quit" {
+			return
+		}
 		var cmd, ok = uci.commands[commandName]
 		if ok {
-			cmd(uci, cmdArgs[1:])
+			if !uci.searchCommands[commandName] {
+				uci.session.Finish()
+			}
+			uci.runCommand(cmd, cmdArgs[1:])
 		} else {
-			DebugUci("Command not found.")
+			uci.DebugUci("Command not found.")
 		}
 	}
 }
 
-func DebugUci(s string) {
-	fmt.Println("info string " + s)
+// runCommand reports a panic of the command handler instead of terminating the engine.
+func (uci *UciProtocol) runCommand(cmd commandHandler, args []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			uci.DebugUci(fmt.Sprint("Command failed: ", r))
+		}
+	}()
+	cmd(uci, args)
+}
+
+func (uci *UciProtocol) DebugUci(s string) {
+	fmt.Fprintln(uci.output, "info string "+s)
 }
@@ -0,0 +1,416 @@
+package shell
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/CounterGo/engine"
+)
+
+// testOutput collects output lines and lets the script wait for bestmove.
+type testOutput struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	text      string
+	bestMoves int
+}
+
+func newTestOutput() *testOutput {
+	var out = &testOutput{}
+	out.cond = sync.NewCond(&out.mu)
+	return out
+}
+
+func (out *testOutput) Write(p []byte) (int, error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.text += string(p)
+	out.bestMoves = strings.Count(out.text, "bestmove ")
+	out.cond.Broadcast()
+	return len(p), nil
+}
+
+func (out *testOutput) waitBestMoves(count int) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for out.bestMoves < count {
+		out.cond.Wait()
+	}
+}
+
+func (out *testOutput) Lines() []string {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return strings.Split(strings.TrimSpace(out.text), "\n")
+}
+
+// testScript feeds commands one by one. The pseudo command "wait"
+// blocks until every go command so far has answered with bestmove.
+type testScript struct {
+	commands []string
+	out      *testOutput
+	goCount  int
+}
+
+func (s *testScript) Read(p []byte) (int, error) {
+	for len(s.commands) > 0 {
+		var command = s.commands[0]
+		s.commands = s.commands[1:]
+		if command == "wait" {
+			s.out.waitBestMoves(s.goCount)
+			continue
+		}
+		if strings.HasPrefix(command, "go") {
+			s.goCount++
+		}
+		return copy(p, command+"\n"), nil
+	}
+	return 0, io.EOF
+}
+
+func runUciScript(commands []string) []string {
+	var uciEngine = engine.NewEngine()
+	uciEngine.Threads.Value = 1
+	return runEngineScript(uciEngine, commands)
+}
+
+func runEngineScript(uciEngine UciEngine, commands []string) []string {
+	var out = newTestOutput()
+	var uci = NewUciProtocol(uciEngine, &testScript{commands: commands, out: out}, out)
+	uci.Run()
+	return out.Lines()
+}
+
+func countPrefix(lines []string, prefix string) int {
+	var result = 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			result++
+		}
+	}
+	return result
+}
+
+// containsInOrder reports whether every prefix starts some line, in the given order.
+func containsInOrder(lines, prefixes []string) bool {
+	var i = 0
+	for _, line := range lines {
+		if i < len(prefixes) && strings.HasPrefix(line, prefixes[i]) {
+			i++
+		}
+	}
+	return i == len(prefixes)
+}
+
+func TestUciConformance(t *testing.T) {
+	var tests = []struct {
+		name      string
+		commands  []string
+		want      []string
+		bestMoves int
+	}{
+		{"uci", []string{"uci"},
+			[]string{"id name Counter", "id author", "option name Hash type spin", "uciok"}, 0},
+		{"isready", []string{"isready"}, []string{"readyok"}, 0},
+		{"go depth", []string{"position startpos", "go depth 2", "wait"}, []string{"bestmove"}, 1},
+		{"mate in one", []string{"position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1", "go depth 3", "wait"},
+			[]string{"bestmove a1a8"}, 1},
+		{"position moves", []string{"position startpos moves e2e4 e7e5 g1f3 b8c6 f1b5 a7a6",
+			"go depth 3 searchmoves b5a4 b5c6", "wait"}, []string{"bestmove b5"}, 1},
+		{"stop infinite", []string{"go infinite", "stop"}, []string{"bestmove"}, 1},
+		{"quit stops search", []string{"go infinite", "quit", "go depth 1"}, []string{"bestmove"}, 1},
+		{"eof stops search", []string{"go infinite"}, []string{"bestmove"}, 1},
+		{"stop when idle", []string{"stop", "stop"}, nil, 0},
+		{"isready during search", []string{"go infinite", "isready", "stop"},
+			[]string{"readyok", "bestmove"}, 1},
+		{"ponderhit", []string{"go ponder wtime 1000 btime 1000", "ponderhit", "wait"},
+			[]string{"bestmove"}, 1},
+		{"stop ponder", []string{"go ponder wtime 1000 btime 1000", "stop"}, []string{"bestmove"}, 1},
+		{"bestmove per go", []string{"go depth 1", "go depth 2", "go depth 3", "wait"},
+			[]string{"bestmove", "bestmove", "bestmove"}, 3},
+		{"go during search", []string{"go infinite", "go depth 1", "wait"},
+			[]string{"bestmove", "bestmove"}, 2},
+		{"setoption during search", []string{"go infinite", "setoption name MultiPV value 2", "go depth 5", "wait"},
+			[]string{"bestmove", "info depth 5 seldepth", "info depth 5 seldepth", "bestmove"}, 2},
+		{"setoption then stop", []string{"go infinite", "setoption name MultiPV value 2", "stop", "isready"},
+			[]string{"bestmove", "readyok"}, 1},
+		{"ucinewgame while pondering", []string{"go ponder wtime 1000 btime 1000", "ucinewgame", "go depth 1", "wait"},
+			[]string{"bestmove", "bestmove"}, 2},
+		{"go during finite search", []string{"go depth 6", "go depth 1", "wait"},
+			[]string{"info depth 6 seldepth", "bestmove", "bestmove"}, 2},
+		{"setoption during finite search", []string{"go depth 6", "setoption name MultiPV value 2", "go depth 5",
+			"wait"}, []string{"info depth 6 seldepth", "bestmove", "info depth 5 seldepth", "info depth 5 seldepth",
+			"bestmove"}, 2},
+		{"quit while pondering", []string{"go ponder wtime 1000 btime 1000", "quit", "go depth 1"},
+			[]string{"bestmove"}, 1},
+		{"ponderhit then go", []string{"go ponder wtime 100000 btime 100000 movetime 200", "ponderhit",
+			"go depth 1", "wait"}, []string{"bestmove", "bestmove"}, 2},
+		{"multipv", []string{"setoption name MultiPV value 3", "go depth 5", "wait"},
+			[]string{"info depth 5 seldepth", "info depth 5 seldepth", "info depth 5 seldepth", "bestmove"}, 1},
+		{"unknown command", []string{"foo"}, []string{"info string Command not found."}, 0},
+		{"wrong move", []string{"position startpos moves e2e5"}, []string{"info string Wrong move"}, 0},
+
+		// Malformed and truncated input
+		{"empty lines", []string{"", "   ", "\t", "isready"}, []string{"readyok"}, 0},
+		{"uci with args", []string{"uci foo"}, []string{"uciok"}, 0},
+		{"setoption no name", []string{"setoption", "setoption value 1", "setoption name"},
+			[]string{"info string Wrong setoption", "info string Wrong setoption",
+				"info string Wrong setoption"}, 0},
+		{"setoption unknown", []string{"setoption name Foo Bar value 1"},
+			[]string{"info string Unknown option Foo Bar"}, 0},
+		{"setoption wrong value", []string{"setoption name Hash value -1", "setoption name Ponder value maybe",
+			"setoption name Threads"},
+			[]string{"info string Wrong value -1 of option Hash", "info string Wrong value maybe of option Ponder",
+				"info string Wrong value  of option Threads"}, 0},
+		{"setoption name with spaces", []string{"setoption name Skill Level value 20"}, nil, 0},
+		{"position no args", []string{"position"}, []string{"info string Wrong position command"}, 0},
+		{"position wrong token", []string{"position foo"}, []string{"info string Wrong position command"}, 0},
+		{"position fen truncated", []string{"position fen", "position fen 8/8/8 w", "position fen rnbqkbnr/pppppppp"},
+			[]string{"info string Wrong fen", "info string Wrong fen", "info string Wrong fen"}, 0},
+		{"position fen no kings", []string{"position fen 8/8/8/8/8/8/8/8 w - - 0 1"},
+			[]string{"info string Wrong fen"}, 0},
+		{"position fen pawns on last ranks", []string{"position fen P3k3/8/8/8/8/8/8/4K3 w - - 0 1",
+			"position fen 4k3/8/8/8/8/8/8/4K2p b - - 0 1", "go depth 5", "wait"},
+			[]string{"info string Wrong fen", "info string Wrong fen", "bestmove"}, 1},
+		{"position fen short", []string{"position fen 4k3/8/8/8/8/8/8/4K2R w", "go depth 1", "wait"},
+			[]string{"bestmove"}, 1},
+		{"position moves truncated", []string{"position startpos moves", "position startpos moves e2",
+			"position startpos moves e2e4x"}, []string{"info string Wrong move", "info string Wrong move"}, 0},
+		{"wrong fen keeps position", []string{"position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1",
+			"position fen foo", "go depth 3", "wait"}, []string{"info string Wrong fen", "bestmove a1a8"}, 1},
+		{"go truncated", []string{"go depth", "go wtime", "go movetime"},
+			[]string{"info string Missing value", "info string Missing value", "info string Missing value"}, 0},
+		{"go wrong value", []string{"go depth x", "go nodes -1"},
+			[]string{"info string Wrong value", "info string Wrong value"}, 0},
+		{"go unknown parameter", []string{"go foo"}, []string{"info string Unknown go parameter foo"}, 0},
+		{"go wrong searchmoves", []string{"go depth 1 searchmoves e2"},
+			[]string{"info string Wrong searchmoves"}, 0},
+		{"go negative time", []string{"go wtime -100 btime -100", "wait"}, []string{"bestmove"}, 1},
+		{"go no legal moves", []string{"position fen 7k/5Q2/6K1/8/8/8/8/8 b - - 0 1", "go depth 3", "wait"},
+			[]string{"bestmove 0000"}, 1},
+		{"ucinewgame", []string{"ucinewgame", "isready"}, []string{"readyok"}, 0},
+		{"ponderhit when idle", []string{"ponderhit"}, nil, 0},
+		{"eval", []string{"position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1", "eval"},
+			[]string{"info string bishopMobility", "info string kingSafety", "score"}, 0},
+		{"move no args", []string{"move"}, []string{"info string Wrong move command"}, 0},
+		{"move wrong", []string{"move e2e5", "move zz"}, []string{"info string Wrong move", "info string Wrong move"}, 0},
+		{"bench wrong args", []string{"bench x", "bench nps -1", "stats 0"},
+			[]string{"info string Wrong argument x", "info string Wrong argument -1",
+				"info string Wrong argument 0"}, 0},
+		{"calibrate wrong args", []string{"calibrate foo"}, []string{"info string Wrong argument foo"}, 0},
+		{"arena wrong args", []string{"arena foo", "arena contempt x"},
+			[]string{"info string Unknown arena mode foo", "info string Wrong argument x"}, 0},
+		{"arena book wrong args", []string{"arena book", "arena book /nonexistent/book.bin"},
+			[]string{"info string Wrong arguments, expected book file", "info string open /nonexistent/book.bin"}, 0},
+		{"epd missing file", []string{"epd /nonexistent/tests.epd"}, nil, 0},
+		{"status", []string{"status", "isready"}, []string{"readyok"}, 0},
+
+		// Option types
+		{"option types", []string{"uci"}, []string{"option name Hash type spin default 4 min 4 max 65536",
+			"option name Ponder type check default false", "option name Clear Hash type button",
+			"option name TimeControl type combo default Basic var Basic var Cautious",
+			"option name SyzygyPath type string default <empty>",
+			"option name SyzygyProbeDepth type spin default 1 min 1 max 100",
+			"option name EgtbPath type string default <empty>",
+			"option name OwnBook type check default false", "option name Book File type string default <empty>",
+			"option name Book Variety type spin default 50 min 0 max 100", "uciok"}, 0},
+		{"button", []string{"go depth 3", "wait", "setoption name Clear Hash", "go depth 3", "wait"},
+			[]string{"bestmove", "bestmove"}, 2},
+		{"combo", []string{"setoption name TimeControl value cautious", "setoption name TimeControl value foo",
+			"go wtime 1000 btime 1000", "wait"},
+			[]string{"info string Wrong value foo of option TimeControl", "bestmove"}, 1},
+
+		// Tablebases
+		{"syzygy path missing", []string{"setoption name SyzygyPath value /nonexistent/syzygy", "go depth 3", "wait"},
+			[]string{"info string Syzygy tablebases not loaded: open /nonexistent/syzygy", "bestmove"}, 1},
+		{"syzygy path empty", []string{"setoption name SyzygyPath value <empty>"}, nil, 0},
+		{"egtb path missing", []string{"setoption name EgtbPath value /nonexistent/endgame"},
+			[]string{"info string Endgame tables not loaded: open /nonexistent/endgame"}, 0},
+		{"egtb wrong args", []string{"egtb", "egtb /nonexistent/endgame KXK"},
+			[]string{"info string Wrong arguments, expected directory",
+				"info string wrong endgame table name KXK"}, 0},
+
+		// Opening book
+		{"book off", []string{"book", "setoption name OwnBook value true", "go depth 1", "wait"},
+			[]string{"info string Book off", "bestmove"}, 1},
+		{"book path missing", []string{"setoption name Book File value /nonexistent/book.bin", "book"},
+			[]string{"info string Book not loaded: open /nonexistent/book.bin",
+				"info string Book not loaded: open /nonexistent/book.bin"}, 0},
+
+		// Hash file
+		{"save wrong args", []string{"save", "load foo"},
+			[]string{"info string Wrong arguments", "info string Wrong arguments"}, 0},
+		{"load missing file", []string{"setoption name Hash File value /nonexistent/counter.hash", "load hash"},
+			[]string{"info string open /nonexistent/counter.hash"}, 0},
+		{"hash file empty", []string{"setoption name Hash File value <empty>", "save hash"},
+			[]string{"info string Hash File option is empty"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines = runUciScript(test.commands)
+			if !containsInOrder(lines, test.want) {
+				t.Errorf("want %q in output:\n%v", test.want, strings.Join(lines, "\n"))
+			}
+			if count := countPrefix(lines, "bestmove"); count != test.bestMoves {
+				t.Errorf("bestmove count %v, want %v:\n%v", count, test.bestMoves, strings.Join(lines, "\n"))
+			}
+		})
+	}
+}
+
+// TestEvalCommand checks that the evaluation tables do not break the UCI stream.
+func TestEvalCommand(t *testing.T) {
+	var lines = runUciScript([]string{"eval"})
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "info string ") && !strings.HasPrefix(line, "score ") {
+			t.Errorf("not a UCI line %q", line)
+		}
+	}
+}
+
+func TestSearchSession(t *testing.T) {
+	var session searchSession
+	var release = make(chan struct{})
+	var searches = 0
+	var search = func(searchParams engine.SearchParams) {
+		searches++
+		<-release
+	}
+	if !session.Start(engine.SearchParams{}, search, nil) {
+		t.Fatal("idle session did not start")
+	}
+	if session.Start(engine.SearchParams{}, search, nil) {
+		t.Error("second search started")
+	}
+	close(release)
+	session.Finish()
+	if session.State() != sessionIdle || searches != 1 {
+		t.Errorf("state %v searches %v", session.State(), searches)
+	}
+	if !session.Start(engine.SearchParams{}, search, nil) {
+		t.Error("session did not start after wait")
+	}
+	session.Finish()
+	// An infinite search ends only when it is cancelled.
+	var infinite = func(searchParams engine.SearchParams) {
+		for !searchParams.CancellationToken.IsCancellationRequested() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	session.Start(engine.SearchParams{Limits: engine.LimitsType{Infinite: true}}, infinite, nil)
+	session.Finish()
+	if session.State() != sessionIdle {
+		t.Error("infinite search not stopped")
+	}
+}
+
+func TestSaveLoadHash(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "hash file.bin")
+	var lines = runUciScript([]string{"setoption name Hash File value " + path,
+		"go depth 6", "wait", "save hash", "load hash", "setoption name Hash value 8", "load hash"})
+	var want = []string{"bestmove", "info string Hash saved", "info string Hash loaded",
+		"info string hash file size 4 MB, Hash is 8 MB"}
+	if !containsInOrder(lines, want) {
+		t.Errorf("want %q in output:\n%v", want, strings.Join(lines, "\n"))
+	}
+}
+
+func TestEndgameTablesCommand(t *testing.T) {
+	var dir = t.TempDir()
+	var lines = runUciScript([]string{"egtb " + dir + " KQK", "setoption name EgtbPath value " + dir,
+		"position fen 8/8/8/4k3/8/8/8/1Q2K3 w - - 0 1", "go depth 3", "wait"})
+	var want = []string{"KQK generated", "info string Endgame tables built",
+		"info string Found 1 endgame tables, up to 3 pieces", "bestmove"}
+	if !containsInOrder(lines, want) {
+		t.Errorf("want %q in output:\n%v", want, strings.Join(lines, "\n"))
+	}
+	var mate = false
+	for _, line := range lines {
+		mate = mate || strings.Contains(line, "score mate")
+	}
+	if !mate {
+		t.Errorf("no mate score:\n%v", strings.Join(lines, "\n"))
+	}
+}
+
+func TestBookCommand(t *testing.T) {
+	// e2e4 weight 3 and d2d4 weight 1 in the initial position.
+	var key = engine.PolyglotKey(engine.NewPositionFromFEN(engine.InitialPositionFen))
+	var data []byte
+	for _, entry := range []struct{ move, weight uint16 }{{796, 3}, {731, 1}} {
+		data = binary.BigEndian.AppendUint64(data, key)
+		data = binary.BigEndian.AppendUint16(data, entry.move)
+		data = binary.BigEndian.AppendUint16(data, entry.weight)
+		data = binary.BigEndian.AppendUint32(data, 0)
+	}
+	var path = filepath.Join(t.TempDir(), "book.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lines = runUciScript([]string{"book " + path, "setoption name Book File value " + path,
+		"setoption name OwnBook value true", "setoption name Book Variety value 0",
+		"position startpos", "go wtime 60000 btime 60000", "wait",
+		"position startpos moves e2e4", "book", "go depth 1", "wait"})
+	var want = []string{"key 463b96181691fc9c moves 2", "e2e4 weight 3 75.0% learn 0",
+		"d2d4 weight 1 25.0% learn 0", "info string Book loaded, 2 entries", "bestmove e2e4",
+		"key 823c9b50fd114196 moves 0", "bestmove"}
+	if !containsInOrder(lines, want) {
+		t.Errorf("want %q in output:\n%v", want, strings.Join(lines, "\n"))
+	}
+}
+
+// FuzzUciCommand checks that no input line crashes the protocol. Commands
+// that run long tournaments or benchmarks are not fuzzed.
+func FuzzUciCommand(f *testing.F) {
+	var seeds = []string{
+		"uci", "isready", "ucinewgame", "ponderhit", "stop", "status", "eval",
+		"setoption name Hash value 1", "setoption name Skill Level value 3", "setoption name",
+		"position startpos moves e2e4 e7e5", "position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1",
+		"position fen 8/8 w KQkq e3", "position fen P3k3/8/8/8/8/8/8/4K3 w - - 0 1",
+		"position fen 4k3/8/8/8/8/8/8/4K2p b - - 0 1", "go depth 1", "go nodes 100 searchmoves e2e4",
+		"go wtime 10 btime 10 winc", "go movetime", "go mate 1", "bench x", "arena foo", "move",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	var skip = map[string]bool{"benchmark": true, "bench": true, "stats": true,
+		"calibrate": true, "arena": true, "epd": true, "move": true, "save": true, "load": true,
+		"egtb": true}
+	f.Fuzz(func(t *testing.T, line string) {
+		var fields = strings.Fields(line)
+		if len(fields) > 0 && skip[fields[0]] || strings.ContainsAny(line, "\r\n") {
+			return
+		}
+		var lines = runUciScript([]string{"setoption name Hash value 1", line, "stop", "isready"})
+		for _, s := range lines {
+			if strings.Contains(s, "Command failed") {
+				t.Fatalf("%q: %v", line, s)
+			}
+		}
+		if lines[len(lines)-1] != "readyok" {
+			t.Fatalf("%q: want readyok at end:\n%v", line, strings.Join(lines, "\n"))
+		}
+	})
+}
+
+type panicEngine struct {
+	*engine.Engine
+}
+
+func (e panicEngine) Search(searchParams engine.SearchParams) engine.SearchInfo {
+	panic("search bug")
+}
+
+func TestSearchPanic(t *testing.T) {
+	var lines = runEngineScript(panicEngine{engine.NewEngine()}, []string{"go depth 1", "wait", "isready"})
+	var want = []string{"info string Search failed: search bug", "bestmove 0000", "readyok"}
+	if !containsInOrder(lines, want) {
+		t.Errorf("want %q in output:\n%v", want, strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package syzygy
+
+import "os"
+
+// mapFile reads the whole file where memory mapping is not implemented.
+func mapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd
+
+package syzygy
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file to memory, only the probed pages are read.
+func mapFile(path string) ([]byte, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, errCorruptTable
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
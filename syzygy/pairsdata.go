@@ -0,0 +1,240 @@
+package syzygy
+
+import (
+	"encoding/binary"
+)
+
+// Flags of pairsData.
+const (
+	flagSTM         = 1
+	flagMapped      = 2
+	flagWinPlies    = 4
+	flagLossPlies   = 8
+	flagWide        = 16
+	flagSingleValue = 128
+)
+
+const (
+	sparseEntrySize = 6
+	leafSymbol      = 0xFFF
+)
+
+// pairsData is the compressed data of a table for one side to move and file
+// of the leading pawn. Values are Huffman coded symbols, a symbol stands for
+// a pair of symbols or a single value.
+type pairsData struct {
+	flags           int
+	sizeofBlock     uint64
+	span            uint64
+	numBlocks       uint64
+	maxSymLen       int
+	minSymLen       int
+	lowestSym       []byte
+	btree           []byte
+	blockLength     []byte
+	blockLengthSize uint64
+	sparseIndex     []byte
+	sparseIndexSize uint64
+	data            []byte
+	base64          []uint64
+	symlen          []int
+	pieces          [maxPieces]int
+	groupIdx        [maxPieces + 1]uint64
+	groupLen        [maxPieces + 1]int
+	mapIdx          [4]int
+}
+
+// setGroups splits pieces into groups of pieces encoded together.
+// order holds the positions of the leading group and of the remaining pawns in the index.
+func (d *pairsData) setGroups(t *table, order [2]int, file int) {
+	var n = 0
+	var firstLen = 2
+	if t.hasPawns {
+		firstLen = 0
+	} else if t.hasUniquePieces {
+		firstLen = 3
+	}
+	d.groupLen[n] = 1
+	for i := 1; i < t.pieceCount; i++ {
+		firstLen--
+		if firstLen > 0 || d.pieces[i] == d.pieces[i-1] {
+			d.groupLen[n]++
+		} else {
+			n++
+			d.groupLen[n] = 1
+		}
+	}
+	n++
+	d.groupLen[n] = 0
+
+	var pp = t.hasPawns && t.pawnCount[1] != 0
+	var next = 1
+	var freeSquares = 64 - d.groupLen[0]
+	if pp {
+		next = 2
+		freeSquares -= d.groupLen[1]
+	}
+	var idx uint64 = 1
+	for k := 0; next < n || k == order[0] || k == order[1]; k++ {
+		if k == order[0] {
+			d.groupIdx[0] = idx
+			if t.hasPawns {
+				idx *= leadPawnsSize[d.groupLen[0]][file]
+			} else if t.hasUniquePieces {
+				idx *= 31332
+			} else {
+				idx *= 462
+			}
+		} else if k == order[1] {
+			d.groupIdx[1] = idx
+			idx *= binomial[d.groupLen[1]][48-d.groupLen[0]]
+		} else {
+			d.groupIdx[next] = idx
+			idx *= binomial[d.groupLen[next]][freeSquares]
+			freeSquares -= d.groupLen[next]
+			next++
+		}
+	}
+	d.groupIdx[n] = idx
+}
+
+// size returns the number of indexes.
+func (d *pairsData) size() uint64 {
+	var n = 0
+	for d.groupLen[n] != 0 {
+		n++
+	}
+	return d.groupIdx[n]
+}
+
+// setSizes reads the Huffman code at pos and returns the position after it.
+func (d *pairsData) setSizes(data []byte, pos int) int {
+	d.flags = int(data[pos])
+	pos++
+	if d.flags&flagSingleValue != 0 {
+		d.minSymLen = int(data[pos])
+		return pos + 1
+	}
+	var tbSize = d.size()
+	d.sizeofBlock = 1 << data[pos]
+	d.span = 1 << data[pos+1]
+	d.sparseIndexSize = (tbSize + d.span - 1) / d.span
+	var padding = uint64(data[pos+2])
+	d.numBlocks = uint64(binary.LittleEndian.Uint32(data[pos+3:]))
+	d.blockLengthSize = d.numBlocks + padding
+	d.maxSymLen = int(data[pos+7])
+	d.minSymLen = int(data[pos+8])
+	pos += 9
+	var n = d.maxSymLen - d.minSymLen + 1
+	d.lowestSym = data[pos : pos+2*n]
+	d.base64 = make([]uint64, n)
+	for i := n - 2; i >= 0; i-- {
+		d.base64[i] = (d.base64[i+1] + uint64(d.lowest(i)) - uint64(d.lowest(i+1))) / 2
+	}
+	for i := 0; i < n; i++ {
+		d.base64[i] <<= uint(64 - i - d.minSymLen)
+	}
+	pos += 2 * n
+
+	var symbols = int(binary.LittleEndian.Uint16(data[pos:]))
+	pos += 2
+	d.btree = data[pos : pos+3*symbols]
+	d.symlen = make([]int, symbols)
+	var visited = make([]bool, symbols)
+	for sym := range d.symlen {
+		if !visited[sym] {
+			d.symlen[sym] = d.setSymlen(sym, visited)
+		}
+	}
+	return pos + 3*symbols + symbols&1
+}
+
+// setSymlen returns the number of values minus one represented by sym.
+func (d *pairsData) setSymlen(sym int, visited []bool) int {
+	visited[sym] = true
+	var right = d.right(sym)
+	if right == leafSymbol {
+		return 0
+	}
+	var left = d.left(sym)
+	if !visited[left] {
+		d.symlen[left] = d.setSymlen(left, visited)
+	}
+	if !visited[right] {
+		d.symlen[right] = d.setSymlen(right, visited)
+	}
+	return d.symlen[left] + d.symlen[right] + 1
+}
+
+func (d *pairsData) lowest(i int) int {
+	return int(binary.LittleEndian.Uint16(d.lowestSym[2*i:]))
+}
+
+func (d *pairsData) left(sym int) int {
+	return int(d.btree[3*sym]) | int(d.btree[3*sym+1]&0xF)<<8
+}
+
+func (d *pairsData) right(sym int) int {
+	return int(d.btree[3*sym+2])<<4 | int(d.btree[3*sym+1]>>4)
+}
+
+func (d *pairsData) blockLen(block uint64) int {
+	return int(binary.LittleEndian.Uint16(d.blockLength[2*block:]))
+}
+
+// decompress returns the value stored at idx.
+func (d *pairsData) decompress(idx uint64) int {
+	if d.flags&flagSingleValue != 0 {
+		return d.minSymLen
+	}
+
+	var k = idx / d.span
+	var block = uint64(binary.LittleEndian.Uint32(d.sparseIndex[k*sparseEntrySize:]))
+	var offset = int(binary.LittleEndian.Uint16(d.sparseIndex[k*sparseEntrySize+4:]))
+	offset += int(idx%d.span) - int(d.span/2)
+	for offset < 0 {
+		block--
+		offset += d.blockLen(block) + 1
+	}
+	for offset > d.blockLen(block) {
+		offset -= d.blockLen(block) + 1
+		block++
+	}
+
+	var ptr = block * d.sizeofBlock
+	var buf64 = binary.BigEndian.Uint64(d.data[ptr:])
+	ptr += 8
+	var buf64Size = 64
+	var sym int
+	for {
+		var length = 0
+		for buf64 < d.base64[length] {
+			length++
+		}
+		sym = int((buf64-d.base64[length])>>uint(64-length-d.minSymLen)) & 0xFFFF
+		sym = (sym + d.lowest(length)) & 0xFFFF
+		if offset < d.symlen[sym]+1 {
+			break
+		}
+		offset -= d.symlen[sym] + 1
+		length += d.minSymLen
+		buf64 <<= uint(length)
+		buf64Size -= length
+		if buf64Size <= 32 {
+			buf64Size += 32
+			buf64 |= uint64(binary.BigEndian.Uint32(d.data[ptr:])) << uint(64-buf64Size)
+			ptr += 4
+		}
+	}
+
+	for d.symlen[sym] != 0 {
+		var left = d.left(sym)
+		if offset < d.symlen[left]+1 {
+			sym = left
+		} else {
+			offset -= d.symlen[left] + 1
+			sym = d.right(sym)
+		}
+	}
+	return d.left(sym)
+}
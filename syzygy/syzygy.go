@@ -0,0 +1,655 @@
+// Package syzygy probes Syzygy endgame tablebases.
+//
+// WDL tables (.rtbw) store the result of a position with the 50 move rule,
+// DTZ tables (.rtbz) store the distance to the next capture or pawn move
+// on the way to the result. Tables are read for positions without castling rights
+// and assume that the side to move can not capture en passant, resolving
+// captures is left to the caller.
+package syzygy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Results of WDL probes from the side to move point of view.
+// CursedWin and BlessedLoss are draws by the 50 move rule.
+const (
+	Loss        = -2
+	BlessedLoss = -1
+	Draw        = 0
+	CursedWin   = 1
+	Win         = 2
+)
+
+// ProbeState is the result state of a DTZ probe.
+type ProbeState int
+
+const (
+	ProbeFail ProbeState = iota
+	ProbeOK
+	// ProbeChangeSTM means that the table stores the other side to move.
+	ProbeChangeSTM
+)
+
+// Position is the piece placement a table is probed for.
+// Squares are numbered a1=0, b1=1, ..., h8=63.
+type Position struct {
+	Pawns, Knights, Bishops, Rooks, Queens, Kings, White, Black uint64
+	WhiteMove                                                   bool
+}
+
+// Piece types as in the table files, black pieces have the 8 bit set.
+const (
+	pawn = 1 + iota
+	knight
+	bishop
+	rook
+	queen
+	king
+)
+
+const (
+	wdlTable = iota
+	dtzTable
+)
+
+var (
+	wdlMagic = [4]byte{0x71, 0xE8, 0x23, 0x5D}
+	dtzMagic = [4]byte{0xD7, 0x66, 0x0C, 0xA5}
+)
+
+const (
+	wdlSuffix = ".rtbw"
+	dtzSuffix = ".rtbz"
+)
+
+// Tablebases is a set of tables found in directories.
+// It is safe for concurrent use, tables are loaded by the first probe.
+type Tablebases struct {
+	wdl       map[uint64]*table
+	dtz       map[uint64]*table
+	maxPieces int
+}
+
+type table struct {
+	name            string
+	path            string
+	kind            int
+	key, key2       uint64
+	pieceCount      int
+	hasPawns        bool
+	hasUniquePieces bool
+	pawnCount       [2]int
+	sides           int
+	files           int
+	pairs           [2][4]pairsData
+	data            []byte
+	mapPos          int
+	once            sync.Once
+	err             error
+}
+
+// Open finds the tables in path, a list of directories separated
+// by the OS path list separator.
+func Open(path string) (*Tablebases, error) {
+	var tb = &Tablebases{
+		wdl: make(map[uint64]*table),
+		dtz: make(map[uint64]*table),
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			continue
+		}
+		var entries, err = os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			var fileName = entry.Name()
+			var ext = filepath.Ext(fileName)
+			var tables map[uint64]*table
+			var kind int
+			switch ext {
+			case wdlSuffix:
+				tables, kind = tb.wdl, wdlTable
+			case dtzSuffix:
+				tables, kind = tb.dtz, dtzTable
+			default:
+				continue
+			}
+			var t, ok = newTable(strings.TrimSuffix(fileName, ext), kind)
+			if !ok {
+				continue
+			}
+			if _, found := tables[t.key]; found {
+				continue
+			}
+			t.path = filepath.Join(dir, fileName)
+			tables[t.key] = t
+			tables[t.key2] = t
+			if kind == wdlTable && t.pieceCount > tb.maxPieces {
+				tb.maxPieces = t.pieceCount
+			}
+		}
+	}
+	return tb, nil
+}
+
+// MaxPieces returns the largest number of pieces, kings included, of the WDL tables.
+func (tb *Tablebases) MaxPieces() int {
+	return tb.maxPieces
+}
+
+// Len returns the number of WDL tables.
+func (tb *Tablebases) Len() int {
+	var result = 0
+	for key, t := range tb.wdl {
+		if key == t.key {
+			result++
+		}
+	}
+	return result
+}
+
+// Close releases the table files. Probes must not be running.
+func (tb *Tablebases) Close() error {
+	var result error
+	for _, tables := range [...]map[uint64]*table{tb.wdl, tb.dtz} {
+		for key, t := range tables {
+			if key != t.key || t.data == nil {
+				continue
+			}
+			if err := unmapFile(t.data); err != nil && result == nil {
+				result = err
+			}
+			t.data = nil
+		}
+	}
+	return result
+}
+
+// parseMaterial parses a table name like KRPvKR, the first side is white.
+func parseMaterial(name string) (counts [2][7]int, ok bool) {
+	var sides = strings.Split(name, "v")
+	if len(sides) != 2 {
+		return
+	}
+	var total = 0
+	for side, pieces := range sides {
+		if !strings.HasPrefix(pieces, "K") {
+			return
+		}
+		for _, ch := range pieces {
+			var pieceType = strings.IndexRune("PNBRQK", ch) + 1
+			if pieceType == 0 {
+				return
+			}
+			counts[side][pieceType]++
+			total++
+		}
+		if counts[side][king] != 1 {
+			return
+		}
+	}
+	return counts, total <= maxPieces
+}
+
+func materialKey(counts *[2][7]int, whiteFirst bool) uint64 {
+	var result uint64
+	for side := 0; side < 2; side++ {
+		var color = side
+		if !whiteFirst {
+			color ^= 1
+		}
+		for pieceType := pawn; pieceType <= king; pieceType++ {
+			result |= uint64(counts[side][pieceType]) << uint(4*(6*color+pieceType-1))
+		}
+	}
+	return result
+}
+
+func positionMaterial(p *Position) (counts [2][7]int) {
+	for side, pieces := range [...]uint64{p.White, p.Black} {
+		counts[side][pawn] = bits.OnesCount64(p.Pawns & pieces)
+		counts[side][knight] = bits.OnesCount64(p.Knights & pieces)
+		counts[side][bishop] = bits.OnesCount64(p.Bishops & pieces)
+		counts[side][rook] = bits.OnesCount64(p.Rooks & pieces)
+		counts[side][queen] = bits.OnesCount64(p.Queens & pieces)
+		counts[side][king] = bits.OnesCount64(p.Kings & pieces)
+	}
+	return
+}
+
+func newTable(name string, kind int) (*table, bool) {
+	var counts, ok = parseMaterial(name)
+	if !ok {
+		return nil, false
+	}
+	var t = &table{
+		name: name,
+		kind: kind,
+		key:  materialKey(&counts, true),
+		key2: materialKey(&counts, false),
+	}
+	for side := 0; side < 2; side++ {
+		for pieceType := pawn; pieceType <= king; pieceType++ {
+			t.pieceCount += counts[side][pieceType]
+			if pieceType != king && counts[side][pieceType] == 1 {
+				t.hasUniquePieces = true
+			}
+		}
+	}
+	var whitePawns, blackPawns = counts[0][pawn], counts[1][pawn]
+	t.hasPawns = whitePawns+blackPawns != 0
+	// The side with less pawns leads, it compresses better.
+	if blackPawns == 0 || (whitePawns != 0 && blackPawns >= whitePawns) {
+		t.pawnCount = [2]int{whitePawns, blackPawns}
+	} else {
+		t.pawnCount = [2]int{blackPawns, whitePawns}
+	}
+	t.sides = 1
+	if kind == wdlTable && t.key != t.key2 {
+		t.sides = 2
+	}
+	t.files = 1
+	if t.hasPawns {
+		t.files = 4
+	}
+	return t, true
+}
+
+// ready loads the table file at the first call.
+func (t *table) ready() bool {
+	t.once.Do(func() {
+		var data, err = mapFile(t.path)
+		if err == nil {
+			err = t.init(data)
+			if err != nil {
+				unmapFile(data)
+			}
+		}
+		if err != nil {
+			t.err = fmt.Errorf("%v: %v", t.path, err)
+			return
+		}
+		t.data = data
+	})
+	return t.err == nil
+}
+
+var errCorruptTable = errors.New("corrupt table")
+
+func (t *table) init(data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errCorruptTable
+		}
+	}()
+
+	var magic = wdlMagic
+	if t.kind == dtzTable {
+		magic = dtzMagic
+	}
+	if len(data) < 5 || [4]byte(data[:4]) != magic {
+		return errors.New("wrong magic")
+	}
+	const (
+		split    = 1
+		hasPawns = 2
+	)
+	var flags = data[4]
+	if (flags&hasPawns != 0) != t.hasPawns || (flags&split != 0) != (t.key != t.key2) {
+		return errCorruptTable
+	}
+	var pos = 5
+
+	var pp = t.hasPawns && t.pawnCount[1] != 0
+	for f := 0; f < t.files; f++ {
+		var order = [2][2]int{
+			{int(data[pos] & 0xF), 0xF},
+			{int(data[pos] >> 4), 0xF},
+		}
+		if pp {
+			order[0][1] = int(data[pos+1] & 0xF)
+			order[1][1] = int(data[pos+1] >> 4)
+			pos++
+		}
+		pos++
+		for k := 0; k < t.pieceCount; k++ {
+			for i := 0; i < t.sides; i++ {
+				if i == 0 {
+					t.pairs[i][f].pieces[k] = int(data[pos] & 0xF)
+				} else {
+					t.pairs[i][f].pieces[k] = int(data[pos] >> 4)
+				}
+			}
+			pos++
+		}
+		for i := 0; i < t.sides; i++ {
+			t.pairs[i][f].setGroups(t, order[i], f)
+		}
+	}
+	pos += pos & 1
+
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			pos = t.pairs[i][f].setSizes(data, pos)
+		}
+	}
+
+	if t.kind == dtzTable {
+		t.mapPos = pos
+		for f := 0; f < t.files; f++ {
+			var d = &t.pairs[0][f]
+			if d.flags&flagMapped == 0 {
+				continue
+			}
+			for i := range d.mapIdx {
+				if d.flags&flagWide != 0 {
+					pos += pos & 1
+					d.mapIdx[i] = (pos-t.mapPos)/2 + 1
+					pos += 2*int(binary.LittleEndian.Uint16(data[pos:])) + 2
+				} else {
+					d.mapIdx[i] = pos - t.mapPos + 1
+					pos += int(data[pos]) + 1
+				}
+			}
+		}
+		pos += pos & 1
+	}
+
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = &t.pairs[i][f]
+			var size = int(d.sparseIndexSize) * sparseEntrySize
+			d.sparseIndex = data[pos : pos+size]
+			pos += size
+		}
+	}
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = &t.pairs[i][f]
+			var size = int(d.blockLengthSize) * 2
+			d.blockLength = data[pos : pos+size]
+			pos += size
+		}
+	}
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = &t.pairs[i][f]
+			pos = (pos + 0x3F) &^ 0x3F
+			var size = int(d.numBlocks * d.sizeofBlock)
+			if pos+size > len(data) {
+				return errCorruptTable
+			}
+			d.data = data[pos:]
+			pos += size
+		}
+	}
+	return nil
+}
+
+// ProbeWDLTable returns the WDL value stored in the table of p.
+// The value is wrong if the side to move has a winning capture.
+func (tb *Tablebases) ProbeWDLTable(p *Position) (wdl int, ok bool) {
+	if bits.OnesCount64(p.White|p.Black) == 2 {
+		return Draw, true
+	}
+	var value, state = tb.probeTable(tb.wdl, p, Draw)
+	if state != ProbeOK {
+		return 0, false
+	}
+	return value - 2, true
+}
+
+// ProbeDTZTable returns the DTZ value in plies stored in the table of p with the WDL value wdl,
+// without the sign and the 100 plies of cursed wins and blessed losses.
+// A table stores one side to move, for the other side ProbeChangeSTM is returned.
+func (tb *Tablebases) ProbeDTZTable(p *Position, wdl int) (dtz int, state ProbeState) {
+	if wdl == Draw {
+		return 0, ProbeOK
+	}
+	return tb.probeTable(tb.dtz, p, wdl)
+}
+
+func (tb *Tablebases) probeTable(tables map[uint64]*table, p *Position, wdl int) (value int, state ProbeState) {
+	var counts = positionMaterial(p)
+	var t = tables[materialKey(&counts, true)]
+	if t == nil || !t.ready() {
+		return 0, ProbeFail
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			value, state = 0, ProbeFail
+		}
+	}()
+	var d, file, idx, changeSTM = t.encode(p)
+	if t.kind == dtzTable && changeSTM {
+		return 0, ProbeChangeSTM
+	}
+	value = d.decompress(idx)
+	if t.kind == dtzTable {
+		value = t.mapScore(file, value, wdl)
+	}
+	return value, ProbeOK
+}
+
+func (t *table) mapScore(file, value, wdl int) int {
+	var wdlMap = [...]int{1, 3, 0, 2, 0}
+	var d = &t.pairs[0][file]
+	if d.flags&flagMapped != 0 {
+		var idx = d.mapIdx[wdlMap[wdl+2]] + value
+		if d.flags&flagWide != 0 {
+			value = int(binary.LittleEndian.Uint16(t.data[t.mapPos+2*idx:]))
+		} else {
+			value = int(t.data[t.mapPos+idx])
+		}
+	}
+	if (wdl == Win && d.flags&flagWinPlies == 0) ||
+		(wdl == Loss && d.flags&flagLossPlies == 0) ||
+		wdl == CursedWin || wdl == BlessedLoss {
+		value *= 2
+	}
+	return value + 1
+}
+
+func (p *Position) pieceOn(sq int) int {
+	var b = uint64(1) << uint(sq)
+	var result int
+	switch {
+	case p.Pawns&b != 0:
+		result = pawn
+	case p.Knights&b != 0:
+		result = knight
+	case p.Bishops&b != 0:
+		result = bishop
+	case p.Rooks&b != 0:
+		result = rook
+	case p.Queens&b != 0:
+		result = queen
+	default:
+		result = king
+	}
+	if p.Black&b != 0 {
+		result |= 8
+	}
+	return result
+}
+
+// encode returns the index of p in the table.
+// changeSTM is set if a DTZ table does not store the side to move of p.
+func (t *table) encode(p *Position) (d *pairsData, file int, idx uint64, changeSTM bool) {
+	var squares, pieces [maxPieces]int
+	var size, leadPawnsCnt = 0, 0
+	var leadPawns uint64
+
+	// Tables store positions with the stronger side as white, and if both sides
+	// are equal, with white to move.
+	var counts = positionMaterial(p)
+	var flip = (t.key == t.key2 && !p.WhiteMove) || materialKey(&counts, true) != t.key
+	var flipColor, flipSquares = 0, 0
+	if flip {
+		flipColor, flipSquares = 8, 56
+	}
+	var stm = 0
+	if flip == p.WhiteMove {
+		stm = 1
+	}
+
+	if t.hasPawns {
+		var pc = t.pairs[0][0].pieces[0] ^ flipColor
+		leadPawns = p.Pawns & p.White
+		if pc&8 != 0 {
+			leadPawns = p.Pawns & p.Black
+		}
+		for b := leadPawns; b != 0; b &= b - 1 {
+			squares[size] = bits.TrailingZeros64(b) ^ flipSquares
+			size++
+		}
+		leadPawnsCnt = size
+		var maxIndex = 0
+		for i := 1; i < leadPawnsCnt; i++ {
+			if mapPawns[squares[maxIndex]] < mapPawns[squares[i]] {
+				maxIndex = i
+			}
+		}
+		squares[0], squares[maxIndex] = squares[maxIndex], squares[0]
+		file = fileOf(squares[0])
+		if file > 3 {
+			file = 7 - file
+		}
+	}
+
+	if t.kind == dtzTable {
+		var flags = t.pairs[0][file].flags
+		changeSTM = flags&flagSTM != stm && !(t.key == t.key2 && !t.hasPawns)
+	}
+
+	for b := (p.White | p.Black) ^ leadPawns; b != 0; b &= b - 1 {
+		var sq = bits.TrailingZeros64(b)
+		squares[size] = sq ^ flipSquares
+		pieces[size] = p.pieceOn(sq) ^ flipColor
+		size++
+	}
+
+	d = &t.pairs[stm%t.sides][file]
+
+	// Order the pieces as in the table.
+	for i := leadPawnsCnt; i < size-1; i++ {
+		for j := i + 1; j < size; j++ {
+			if d.pieces[i] == pieces[j] {
+				pieces[i], pieces[j] = pieces[j], pieces[i]
+				squares[i], squares[j] = squares[j], squares[i]
+				break
+			}
+		}
+	}
+
+	// The leading piece goes to files a-d.
+	if fileOf(squares[0]) > 3 {
+		for i := 0; i < size; i++ {
+			squares[i] = flipFile(squares[i])
+		}
+	}
+
+	if t.hasPawns {
+		idx = leadPawnIdx[leadPawnsCnt][squares[0]]
+		sortSquares(squares[1:leadPawnsCnt], func(sq int) int { return mapPawns[sq] })
+		for i := 1; i < leadPawnsCnt; i++ {
+			idx += binomial[i][mapPawns[squares[i]]]
+		}
+	} else {
+		// Without pawns the leading piece also goes to ranks 1-4
+		// and below the a1-h8 diagonal.
+		if rankOf(squares[0]) > 3 {
+			for i := 0; i < size; i++ {
+				squares[i] = flipRank(squares[i])
+			}
+		}
+		for i := 0; i < d.groupLen[0]; i++ {
+			if offA1H8(squares[i]) == 0 {
+				continue
+			}
+			if offA1H8(squares[i]) > 0 {
+				for j := i; j < size; j++ {
+					squares[j] = ((squares[j] >> 3) | (squares[j] << 3)) & 63
+				}
+			}
+			break
+		}
+
+		if t.hasUniquePieces {
+			var adjust1, adjust2 = 0, 0
+			if squares[1] > squares[0] {
+				adjust1++
+			}
+			if squares[2] > squares[0] {
+				adjust2++
+			}
+			if squares[2] > squares[1] {
+				adjust2++
+			}
+			if offA1H8(squares[0]) != 0 {
+				idx = uint64((mapA1D1D4[squares[0]]*63+(squares[1]-adjust1))*62 +
+					squares[2] - adjust2)
+			} else if offA1H8(squares[1]) != 0 {
+				idx = uint64((6*63+rankOf(squares[0])*28+mapB1H1H7[squares[1]])*62 +
+					squares[2] - adjust2)
+			} else if offA1H8(squares[2]) != 0 {
+				idx = uint64(6*63*62 + 4*28*62 +
+					rankOf(squares[0])*7*28 +
+					(rankOf(squares[1])-adjust1)*28 +
+					mapB1H1H7[squares[2]])
+			} else {
+				idx = uint64(6*63*62 + 4*28*62 + 4*7*28 +
+					rankOf(squares[0])*7*6 +
+					(rankOf(squares[1])-adjust1)*6 +
+					(rankOf(squares[2]) - adjust2))
+			}
+		} else {
+			idx = uint64(mapKK[mapA1D1D4[squares[0]]][squares[1]])
+		}
+	}
+
+	// Remaining groups, squares in ascending order and below the squares of the previous groups.
+	idx *= d.groupIdx[0]
+	var groupStart = d.groupLen[0]
+	var remainingPawns = t.hasPawns && t.pawnCount[1] != 0
+	for next := 1; d.groupLen[next] != 0; next++ {
+		var group = squares[groupStart : groupStart+d.groupLen[next]]
+		sortSquares(group, func(sq int) int { return sq })
+		var n uint64
+		for i, sq := range group {
+			var adjust = 0
+			for _, prev := range squares[:groupStart] {
+				if sq > prev {
+					adjust++
+				}
+			}
+			if remainingPawns {
+				adjust += 8
+			}
+			n += binomial[i+1][sq-adjust]
+		}
+		remainingPawns = false
+		idx += n * d.groupIdx[next]
+		groupStart += d.groupLen[next]
+	}
+	return
+}
+
+// sortSquares is a stable insertion sort, groups have a few squares.
+func sortSquares(squares []int, key func(sq int) int) {
+	for i := 1; i < len(squares); i++ {
+		for j := i; j > 0 && key(squares[j-1]) > key(squares[j]); j-- {
+			squares[j-1], squares[j] = squares[j], squares[j-1]
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package syzygy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexTables(t *testing.T) {
+	var codes = make(map[int]bool)
+	for idx := range mapKK {
+		for sq, code := range mapKK[idx] {
+			if code != 0 || (idx == 0 && sq == 0) {
+				codes[code] = true
+			}
+		}
+	}
+	if len(codes) != 462 {
+		t.Errorf("mapKK has %v codes, expected 462", len(codes))
+	}
+	for code := 0; code < 462; code++ {
+		if !codes[code] {
+			t.Errorf("mapKK misses code %v", code)
+		}
+	}
+
+	var pawnCodes = make(map[int]bool)
+	for sq := 8; sq < 56; sq++ {
+		pawnCodes[mapPawns[sq]] = true
+	}
+	if len(pawnCodes) != 48 {
+		t.Errorf("mapPawns has %v codes, expected 48", len(pawnCodes))
+	}
+
+	if binomial[3][10] != 120 || binomial[5][63] != 7028847 {
+		t.Error("wrong binomial coefficients")
+	}
+	var total uint64
+	for file := 0; file < 4; file++ {
+		total += leadPawnsSize[1][file]
+	}
+	if total != 24 {
+		t.Errorf("one leading pawn has %v squares, expected 24", total)
+	}
+}
+
+// distanceValue depends on the king distance only,
+// so positions that are mirrors of each other have the same value.
+func distanceValue(p *Position) int {
+	var white, black = p.Kings & p.White, p.Kings & p.Black
+	var d = kingDistance(trailingZeros(white), trailingZeros(black))
+	if d <= 1 {
+		return -100
+	}
+	return d
+}
+
+func trailingZeros(b uint64) int {
+	var result = 0
+	for b&1 == 0 {
+		b >>= 1
+		result++
+	}
+	return result
+}
+
+func TestWriteTable(t *testing.T) {
+	var dir = t.TempDir()
+	for _, name := range []string{"KQvK", "KPvK"} {
+		for _, dtz := range []bool{false, true} {
+			var ext = wdlSuffix
+			if dtz {
+				ext = dtzSuffix
+			}
+			var file, err = os.Create(filepath.Join(dir, name+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = WriteTable(file, name, dtz, func(p *Position) (int, bool) {
+				var d = distanceValue(p)
+				if d < 0 {
+					return 0, false
+				}
+				if dtz {
+					// the sign is the result of the probe below
+					if d%2 == 0 {
+						return -d, true
+					}
+					return d, true
+				}
+				return d%5 - 2, true
+			})
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var tb, err = Open(dir + string(os.PathListSeparator) + filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("missing directory is not reported")
+	}
+	tb, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if tb.Len() != 2 || tb.MaxPieces() != 3 {
+		t.Fatalf("found %v tables up to %v pieces", tb.Len(), tb.MaxPieces())
+	}
+
+	var tests = []struct {
+		white, black  []int
+		blackStronger bool
+	}{
+		{[]int{king, queen}, []int{king}, false},
+		{[]int{king}, []int{king, queen}, true},
+		{[]int{king, pawn}, []int{king}, false},
+		{[]int{king}, []int{king, pawn}, true},
+	}
+	for _, test := range tests {
+		var pieces []int
+		for _, piece := range test.white {
+			pieces = append(pieces, piece)
+		}
+		for _, piece := range test.black {
+			pieces = append(pieces, piece|8)
+		}
+		var count = 0
+		var p Position
+		var place func(k int, occupied uint64, seed int)
+		place = func(k int, occupied uint64, seed int) {
+			if k == len(pieces) {
+				count++
+				for _, whiteMove := range []bool{true, false} {
+					p.WhiteMove = whiteMove
+					var d = distanceValue(&p)
+					if d < 0 {
+						continue
+					}
+					if wdl, ok := tb.ProbeWDLTable(&p); !ok || wdl != d%5-2 {
+						t.Fatalf("%v %v: wdl %v %v, expected %v", test, p, wdl, ok, d%5-2)
+					}
+					var wdl = Win
+					if d%2 == 0 {
+						wdl = Loss
+					}
+					var dtz, state = tb.ProbeDTZTable(&p, wdl)
+					if state == ProbeOK && dtz != d {
+						t.Fatalf("%v %v: dtz %v, expected %v", test, p, dtz, d)
+					}
+					// DTZ tables store the stronger side to move
+					var changeSTM = whiteMove == test.blackStronger
+					if state == ProbeFail || (state == ProbeChangeSTM) != changeSTM {
+						t.Fatalf("%v %v: dtz state %v", test, p, state)
+					}
+				}
+				return
+			}
+			var piece = pieces[k]
+			// a sample of the positions: the squares of the first pieces vary most
+			for sq := (seed * 7) % 5; sq < 64; sq += 1 + k*k {
+				var b = uint64(1) << uint(sq)
+				if occupied&b != 0 || (piece&7 == pawn && (sq < 8 || sq >= 56)) {
+					continue
+				}
+				p.setPiece(piece, b)
+				place(k+1, occupied|b, seed+sq)
+				p.setPiece(piece, b)
+			}
+		}
+		place(0, 0, 0)
+		if count == 0 {
+			t.Errorf("%v: no positions", test)
+		}
+	}
+}
+
+// newPosition places pieces on squares, a1 is 0 and h8 is 63.
+func newPosition(whiteMove bool, pieces map[int]int) *Position {
+	var p = &Position{WhiteMove: whiteMove}
+	for sq, piece := range pieces {
+		p.setPiece(piece, uint64(1)<<uint(sq))
+	}
+	return p
+}
+
+// TestTestdata reads the tables in testdata, they are written by the engine tests
+// with WriteTable from a retrograde solution: go test ./engine -run TestSyzygy -update
+func TestTestdata(t *testing.T) {
+	var tb, err = Open("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if tb.Len() != 5 {
+		t.Fatalf("found %v tables", tb.Len())
+	}
+
+	const (
+		a1, b1, a8, b2, f6, g6, h8 = 0, 1, 56, 9, 45, 46, 63
+		wK, wQ, wR, bK             = king, queen, rook, king | 8
+	)
+	var tests = []struct {
+		p        *Position
+		wdl, dtz int
+	}{
+		// mate in one
+		{newPosition(true, map[int]int{g6: wK, b1: wQ, h8: bK}), Win, 1},
+		{newPosition(true, map[int]int{g6: wK, a1: wR, h8: bK}), Win, 1},
+		// mated
+		{newPosition(false, map[int]int{g6: wK, a8: wR, h8: bK}), Loss, 0},
+		// stalemate
+		{newPosition(false, map[int]int{f6: wK, g6: wQ, h8: bK}), Draw, 0},
+		// the rook is lost
+		{newPosition(false, map[int]int{h8: wK, b1: wR, a1: bK}), Draw, 0},
+		{newPosition(false, map[int]int{h8: wK, b2: wQ, a1: bK}), Draw, 0},
+	}
+	for _, test := range tests {
+		var wdl, ok = tb.ProbeWDLTable(test.p)
+		if !ok || wdl != test.wdl {
+			t.Errorf("%v: wdl %v %v, expected %v", test.p, wdl, ok, test.wdl)
+		}
+		if test.dtz != 0 {
+			if dtz, state := tb.ProbeDTZTable(test.p, test.wdl); state != ProbeOK || dtz != test.dtz {
+				t.Errorf("%v: dtz %v %v, expected %v", test.p, dtz, state, test.dtz)
+			}
+		}
+	}
+
+	// The longest wins are mates in 10 and 16 moves, without a zeroing move.
+	for _, test := range []struct {
+		piece, longest int
+	}{{queen, 19}, {rook, 31}} {
+		var longest = 0
+		for wk := 0; wk < 64; wk++ {
+			for sq := 0; sq < 64; sq++ {
+				for bk := 0; bk < 64; bk++ {
+					if wk == sq || wk == bk || sq == bk || kingDistance(wk, bk) <= 1 {
+						continue
+					}
+					var p = newPosition(true, map[int]int{wk: wK, sq: test.piece, bk: bK})
+					if wdl, ok := tb.ProbeWDLTable(p); !ok || wdl != Win {
+						continue
+					}
+					var dtz, state = tb.ProbeDTZTable(p, Win)
+					if state != ProbeOK {
+						t.Fatalf("%v: dtz %v", p, state)
+					}
+					longest = max(longest, dtz)
+				}
+			}
+		}
+		if longest != test.longest {
+			t.Errorf("piece %v: longest dtz %v, expected %v", test.piece, longest, test.longest)
+		}
+	}
+
+	// The tables use the features of the format: single values, maps and pairs.
+	var table = func(tables map[uint64]*table, name string) *table {
+		var counts, _ = parseMaterial(name)
+		var result = tables[materialKey(&counts, true)]
+		if result == nil || !result.ready() {
+			t.Fatalf("table %v is not ready", name)
+		}
+		return result
+	}
+	for _, test := range []struct {
+		name  string
+		value int
+	}{{"KNvK", Draw}, {"KBvK", Draw}, {"KQvK", Win}, {"KRvK", Win}} {
+		var d = &table(tb.wdl, test.name).pairs[0][0]
+		if d.flags&flagSingleValue == 0 || d.minSymLen != test.value+2 {
+			t.Errorf("%v: flags %v value %v", test.name, d.flags, d.minSymLen)
+		}
+	}
+	for _, name := range []string{"KQvK", "KRvK", "KPvK"} {
+		for _, d := range []*pairsData{&table(tb.wdl, name).pairs[1][0], &table(tb.dtz, name).pairs[0][0]} {
+			var pairs = 0
+			for _, length := range d.symlen {
+				if length != 0 {
+					pairs++
+				}
+			}
+			if d.flags&flagSingleValue != 0 || d.maxSymLen == d.minSymLen || pairs == 0 {
+				t.Errorf("%v: flags %v code lengths %v-%v pairs %v", name, d.flags, d.minSymLen, d.maxSymLen, pairs)
+			}
+		}
+		if d := &table(tb.dtz, name).pairs[0][0]; d.flags&flagMapped == 0 {
+			t.Errorf("%v: dtz is not mapped", name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package syzygy
+
+// Index tables of the Syzygy encoding, built as in the probing code
+// published with the tables.
+
+const maxPieces = 7
+
+var (
+	// mapB1H1H7 maps the squares below the a1-h8 diagonal to 0..27.
+	mapB1H1H7 [64]int
+	// mapA1D1D4 maps the a1-d1-d4 triangle to 0..9, the diagonal squares last.
+	mapA1D1D4 [64]int
+	// mapKK encodes the 462 legal placements of two kings with the first king in a1-d1-d4.
+	mapKK [10][64]int
+	// mapPawns maps the squares a2-h7 to 0..47, the squares near the a and h files first.
+	mapPawns      [64]int
+	leadPawnIdx   [maxPieces][64]uint64
+	leadPawnsSize [maxPieces][4]uint64
+	binomial      [maxPieces][64]uint64
+)
+
+func fileOf(sq int) int {
+	return sq & 7
+}
+
+func rankOf(sq int) int {
+	return sq >> 3
+}
+
+func offA1H8(sq int) int {
+	return rankOf(sq) - fileOf(sq)
+}
+
+func flipFile(sq int) int {
+	return sq ^ 7
+}
+
+func flipRank(sq int) int {
+	return sq ^ 56
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func kingDistance(sq1, sq2 int) int {
+	var fileDistance = abs(fileOf(sq1) - fileOf(sq2))
+	var rankDistance = abs(rankOf(sq1) - rankOf(sq2))
+	if fileDistance > rankDistance {
+		return fileDistance
+	}
+	return rankDistance
+}
+
+func init() {
+	var code = 0
+	for sq := 0; sq < 64; sq++ {
+		if offA1H8(sq) < 0 {
+			mapB1H1H7[sq] = code
+			code++
+		}
+	}
+
+	code = 0
+	var diagonal []int
+	for _, sq := range [...]int{0, 1, 2, 3, 8, 9, 10, 11, 16, 17, 18, 19, 24, 25, 26, 27} {
+		if offA1H8(sq) < 0 {
+			mapA1D1D4[sq] = code
+			code++
+		} else if offA1H8(sq) == 0 {
+			diagonal = append(diagonal, sq)
+		}
+	}
+	for _, sq := range diagonal {
+		mapA1D1D4[sq] = code
+		code++
+	}
+
+	type kk struct{ idx, sq int }
+	var bothOnDiagonal []kk
+	code = 0
+	for idx := 0; idx < 10; idx++ {
+		for s1 := 0; s1 <= 27; s1++ {
+			if mapA1D1D4[s1] != idx || (idx == 0 && s1 != 1) {
+				continue
+			}
+			for s2 := 0; s2 < 64; s2++ {
+				if kingDistance(s1, s2) <= 1 {
+					continue
+				} else if offA1H8(s1) == 0 && offA1H8(s2) > 0 {
+					continue
+				} else if offA1H8(s1) == 0 && offA1H8(s2) == 0 {
+					bothOnDiagonal = append(bothOnDiagonal, kk{idx, s2})
+				} else {
+					mapKK[idx][s2] = code
+					code++
+				}
+			}
+		}
+	}
+	for _, item := range bothOnDiagonal {
+		mapKK[item.idx][item.sq] = code
+		code++
+	}
+
+	binomial[0][0] = 1
+	for n := 1; n < 64; n++ {
+		for k := 0; k < maxPieces && k <= n; k++ {
+			if k > 0 {
+				binomial[k][n] += binomial[k-1][n-1]
+			}
+			if k < n {
+				binomial[k][n] += binomial[k][n-1]
+			}
+		}
+	}
+
+	var availableSquares = 47
+	for leadPawnsCnt := 1; leadPawnsCnt < maxPieces; leadPawnsCnt++ {
+		for file := 0; file < 4; file++ {
+			var idx uint64
+			for rank := 1; rank <= 6; rank++ {
+				var sq = rank*8 + file
+				if leadPawnsCnt == 1 {
+					mapPawns[sq] = availableSquares
+					availableSquares--
+					mapPawns[flipFile(sq)] = availableSquares
+					availableSquares--
+				}
+				leadPawnIdx[leadPawnsCnt][sq] = idx
+				idx += binomial[leadPawnsCnt-1][mapPawns[flipRank(sq)]]
+			}
+			leadPawnsSize[leadPawnsCnt][file] = idx
+		}
+	}
+}
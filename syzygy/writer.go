@@ -0,0 +1,641 @@
+package syzygy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	writerBlockBits = 5
+	writerSpanBits  = 10
+	// writerMaxSymbols is the number of symbols of a Huffman code, pairs included.
+	writerMaxSymbols = leafSymbol
+	// writerMinPairs is the number of occurrences of a pair that pays for its symbol.
+	writerMinPairs = 8
+	// writerMaxPairValues is the number of values of the longest pair symbol.
+	writerMaxPairValues = 256
+	// writerMaxCodeLength is the longest Huffman code the decoder reads.
+	writerMaxCodeLength = 32
+)
+
+// dontCare marks the value of an illegal position.
+const dontCare = math.MinInt
+
+// WriteTable writes the table name, like KRvK, in the Syzygy format. value returns
+// the WDL value of a position for a WDL table or the DTZ in plies for a DTZ table,
+// ok is false for illegal positions. DTZ tables store white to move.
+// Values are compressed like in the files of the Syzygy generator: illegal positions
+// and draws of DTZ tables take the previous value, frequent pairs of symbols become
+// new symbols, symbols are Huffman coded and DTZ values are indexes into a map of
+// each result. It is meant for small tables, bigger tables take long to compress.
+func WriteTable(w io.Writer, name string, dtz bool, value func(p *Position) (v int, ok bool)) error {
+	var kind = wdlTable
+	if dtz {
+		kind = dtzTable
+	}
+	var counts, ok = parseMaterial(name)
+	if !ok {
+		return fmt.Errorf("wrong table name %v", name)
+	}
+	var t, _ = newTable(name, kind)
+	var pieces = writerPieces(t, counts)
+	var pp = t.hasPawns && t.pawnCount[1] != 0
+	var order = [2]int{0, 0xF}
+	if pp {
+		order[1] = 1
+	}
+
+	var values [2][4][]int
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = &t.pairs[i][f]
+			copy(d.pieces[:], pieces)
+			d.setGroups(t, order, f)
+			if kind == dtzTable {
+				d.flags = flagWinPlies | flagLossPlies
+			}
+			values[i][f] = make([]int, d.size())
+			for j := range values[i][f] {
+				values[i][f][j] = dontCare
+			}
+		}
+	}
+
+	var err error
+	var p Position
+	var place func(k int, occupied uint64)
+	place = func(k int, occupied uint64) {
+		if err != nil {
+			return
+		}
+		if k == len(pieces) {
+			for _, whiteMove := range [...]bool{true, false} {
+				p.WhiteMove = whiteMove
+				var d, file, idx, changeSTM = t.encode(&p)
+				if changeSTM {
+					continue
+				}
+				var v, ok = value(&p)
+				if !ok {
+					continue
+				}
+				var side = 0
+				if d == &t.pairs[1][file] {
+					side = 1
+				}
+				if kind == dtzTable {
+					if dtzSymbol(v) > 0xFFFF {
+						err = fmt.Errorf("value %v out of range", v)
+						return
+					}
+					if v != 0 {
+						values[side][file][idx] = v
+					}
+					continue
+				}
+				if v < Loss || v > Win {
+					err = fmt.Errorf("value %v out of range", v)
+					return
+				}
+				values[side][file][idx] = v + 2
+			}
+			return
+		}
+		var piece = pieces[k]
+		for sq := 0; sq < 64; sq++ {
+			var b = uint64(1) << uint(sq)
+			if occupied&b != 0 || (piece&7 == pawn && (sq < 8 || sq >= 56)) {
+				continue
+			}
+			p.setPiece(piece, b)
+			place(k+1, occupied|b)
+			p.setPiece(piece, b)
+		}
+	}
+	place(0, 0)
+	if err != nil {
+		return err
+	}
+	return writeTableFile(w, t, pieces, values)
+}
+
+// dtzSymbol returns the stored DTZ value, cursed results are stored in moves.
+func dtzSymbol(dtz int) int {
+	dtz = abs(dtz)
+	if dtz == 0 {
+		return 0
+	}
+	if dtz > 100 {
+		return (dtz - 101) / 2
+	}
+	return dtz - 1
+}
+
+func (p *Position) setPiece(piece int, b uint64) {
+	switch piece & 7 {
+	case pawn:
+		p.Pawns ^= b
+	case knight:
+		p.Knights ^= b
+	case bishop:
+		p.Bishops ^= b
+	case rook:
+		p.Rooks ^= b
+	case queen:
+		p.Queens ^= b
+	case king:
+		p.Kings ^= b
+	}
+	if piece&8 == 0 {
+		p.White ^= b
+	} else {
+		p.Black ^= b
+	}
+}
+
+// writerPieces returns the pieces in the order of the index:
+// leading pawns, remaining pawns, or three unique pieces, or the kings first.
+func writerPieces(t *table, counts [2][7]int) []int {
+	var result []int
+	var add = func(side, pieceType int) {
+		for ; counts[side][pieceType] > 0; counts[side][pieceType]-- {
+			result = append(result, pieceType|side<<3)
+		}
+	}
+	if t.hasPawns {
+		var lead = 0
+		if counts[0][pawn] != t.pawnCount[0] {
+			lead = 1
+		}
+		add(lead, pawn)
+		add(lead^1, pawn)
+	} else if t.hasUniquePieces {
+	unique:
+		for side := 0; side < 2; side++ {
+			for pieceType := knight; pieceType <= queen; pieceType++ {
+				if counts[side][pieceType] == 1 {
+					add(side, pieceType)
+					break unique
+				}
+			}
+		}
+	}
+	add(0, king)
+	add(1, king)
+	for side := 0; side < 2; side++ {
+		for pieceType := knight; pieceType <= queen; pieceType++ {
+			add(side, pieceType)
+		}
+	}
+	return result
+}
+
+// encodedData is the compressed data of a pairsData.
+type encodedData struct {
+	flags       int
+	value       int
+	minLen      int
+	maxLen      int
+	lowest      []int
+	tree        [][2]int
+	blocks      [][]byte
+	blockValues []int
+}
+
+// dtzMaps replaces the DTZ values by indexes into the maps of their results,
+// the most frequent values come first. Draws are left as they are.
+func dtzMaps(values []int) (maps [4][]int) {
+	var counts [4]map[int]int
+	for i := range counts {
+		counts[i] = make(map[int]int)
+	}
+	for _, v := range values {
+		if v != dontCare {
+			counts[dtzClass(v)][dtzSymbol(v)]++
+		}
+	}
+	var index [4]map[int]int
+	for i := range maps {
+		for symbol := range counts[i] {
+			maps[i] = append(maps[i], symbol)
+		}
+		sort.Slice(maps[i], func(a, b int) bool {
+			var x, y = maps[i][a], maps[i][b]
+			if counts[i][x] != counts[i][y] {
+				return counts[i][x] > counts[i][y]
+			}
+			return x < y
+		})
+		index[i] = make(map[int]int)
+		for j, symbol := range maps[i] {
+			index[i][symbol] = j
+		}
+	}
+	for j, v := range values {
+		if v != dontCare {
+			values[j] = index[dtzClass(v)][dtzSymbol(v)]
+		}
+	}
+	return maps
+}
+
+// dtzClass returns the map of a DTZ value: win, loss, cursed win or blessed loss.
+func dtzClass(dtz int) int {
+	switch {
+	case dtz > 100:
+		return 2
+	case dtz > 0:
+		return 0
+	case dtz < -100:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// encode compresses values, the symbols of the values are smaller than leafSymbol.
+func encode(values []int, flags int) (*encodedData, error) {
+	var result = &encodedData{flags: flags}
+	var previous = 0
+	for _, v := range values {
+		if v != dontCare {
+			previous = v
+			break
+		}
+	}
+	var seq = make([]int, len(values))
+	for i, v := range values {
+		if v != dontCare {
+			previous = v
+		}
+		seq[i] = previous
+	}
+	var single = true
+	for _, v := range seq {
+		if v >= leafSymbol {
+			return nil, fmt.Errorf("symbol %v out of range", v)
+		}
+		single = single && v == seq[0]
+	}
+	if single {
+		result.flags |= flagSingleValue
+		if len(seq) != 0 {
+			result.value = seq[0]
+		}
+		return result, nil
+	}
+
+	var tree [][2]int
+	for _, v := range seq {
+		for len(tree) <= v {
+			tree = append(tree, [2]int{len(tree), leafSymbol})
+		}
+	}
+	seq, tree = pairSymbols(seq, tree)
+
+	var freq = make([]int, len(tree))
+	for _, symbol := range seq {
+		freq[symbol]++
+	}
+	var lengths, err = codeLengths(freq)
+	if err != nil {
+		return nil, err
+	}
+	// Canonical code: longer codes get the lower symbols and the lower code values.
+	var order = make([]int, len(tree))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return lengths[order[a]] > lengths[order[b]]
+	})
+	var id = make([]int, len(tree))
+	for i, symbol := range order {
+		id[symbol] = i
+	}
+	result.minLen, result.maxLen = writerMaxCodeLength, 0
+	for _, length := range lengths {
+		if length != 0 {
+			result.minLen = min(result.minLen, length)
+			result.maxLen = max(result.maxLen, length)
+		}
+	}
+	var n = result.maxLen - result.minLen + 1
+	var count = make([]int, n)
+	for _, length := range lengths {
+		if length != 0 {
+			count[length-result.minLen]++
+		}
+	}
+	result.lowest = make([]int, n)
+	var base = make([]int, n)
+	for i := n - 2; i >= 0; i-- {
+		result.lowest[i] = result.lowest[i+1] + count[i+1]
+		base[i] = (base[i+1] + count[i+1]) / 2
+	}
+	result.tree = make([][2]int, len(tree))
+	for symbol, node := range tree {
+		if node[1] == leafSymbol {
+			result.tree[id[symbol]] = node
+		} else {
+			result.tree[id[symbol]] = [2]int{id[node[0]], id[node[1]]}
+		}
+	}
+
+	var valueCount = make([]int, len(tree))
+	for symbol := range tree {
+		valueCount[symbol] = symbolValues(tree, symbol)
+	}
+	const blockSize = 1 << writerBlockBits
+	var block []byte
+	var bit, blockValues = 0, 0
+	for _, symbol := range seq {
+		var length = lengths[symbol]
+		if block == nil || bit+length > 8*blockSize || blockValues+valueCount[symbol] > 1<<16 {
+			if block != nil {
+				result.blocks = append(result.blocks, block)
+				result.blockValues = append(result.blockValues, blockValues)
+			}
+			block = make([]byte, blockSize)
+			bit, blockValues = 0, 0
+		}
+		var i = length - result.minLen
+		var code = base[i] + id[symbol] - result.lowest[i]
+		for b := 0; b < length; b++ {
+			if code>>(length-1-b)&1 != 0 {
+				block[bit/8] |= 0x80 >> (bit % 8)
+			}
+			bit++
+		}
+		blockValues += valueCount[symbol]
+	}
+	result.blocks = append(result.blocks, block)
+	result.blockValues = append(result.blockValues, blockValues)
+	return result, nil
+}
+
+// pairSymbols replaces the most frequent pair of adjacent symbols by a new symbol
+// while the pair is frequent enough to pay for its symbol.
+func pairSymbols(seq []int, tree [][2]int) ([]int, [][2]int) {
+	var values = make([]int, len(tree), writerMaxSymbols)
+	for i := range values {
+		values[i] = 1
+	}
+	for len(tree) < writerMaxSymbols {
+		var counts = make(map[int]int)
+		var last = -1
+		for i := 0; i+1 < len(seq); i++ {
+			var pair = seq[i]<<12 | seq[i+1]
+			if pair == last {
+				// aaa holds one pair aa
+				last = -1
+				continue
+			}
+			if values[seq[i]]+values[seq[i+1]] <= writerMaxPairValues {
+				counts[pair]++
+			}
+			last = pair
+		}
+		var best, bestCount = 0, 0
+		for pair, count := range counts {
+			if count > bestCount || (count == bestCount && pair < best) {
+				best, bestCount = pair, count
+			}
+		}
+		if bestCount < writerMinPairs {
+			break
+		}
+		var left, right = best >> 12, best & 0xFFF
+		var symbol = len(tree)
+		tree = append(tree, [2]int{left, right})
+		values = append(values, values[left]+values[right])
+		var n = 0
+		for i := 0; i < len(seq); i++ {
+			if i+1 < len(seq) && seq[i] == left && seq[i+1] == right {
+				seq[n] = symbol
+				i++
+			} else {
+				seq[n] = seq[i]
+			}
+			n++
+		}
+		seq = seq[:n]
+	}
+	return seq, tree
+}
+
+func symbolValues(tree [][2]int, symbol int) int {
+	if tree[symbol][1] == leafSymbol {
+		return 1
+	}
+	return symbolValues(tree, tree[symbol][0]) + symbolValues(tree, tree[symbol][1])
+}
+
+// codeLengths returns the lengths of the Huffman code of symbols with frequencies freq,
+// symbols that do not occur have no code.
+func codeLengths(freq []int) ([]int, error) {
+	var leaves []int
+	for symbol, f := range freq {
+		if f != 0 {
+			leaves = append(leaves, symbol)
+		}
+	}
+	sort.SliceStable(leaves, func(a, b int) bool {
+		return freq[leaves[a]] < freq[leaves[b]]
+	})
+	var lengths = make([]int, len(freq))
+	if len(leaves) == 1 {
+		lengths[leaves[0]] = 1
+		return lengths, nil
+	}
+	// Two queues: the leaves and the inner nodes are both sorted by weight.
+	var weight, parent []int
+	for _, symbol := range leaves {
+		weight = append(weight, freq[symbol])
+		parent = append(parent, 0)
+	}
+	var leaf, inner = 0, len(leaves)
+	var take = func() int {
+		if leaf < len(leaves) && (inner == len(weight) || weight[leaf] <= weight[inner]) {
+			leaf++
+			return leaf - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for len(weight) < 2*len(leaves)-1 {
+		var a, b = take(), take()
+		parent[a], parent[b] = len(weight), len(weight)
+		weight = append(weight, weight[a]+weight[b])
+		parent = append(parent, 0)
+	}
+	var depth = make([]int, len(weight))
+	for i := len(weight) - 2; i >= 0; i-- {
+		depth[i] = depth[parent[i]] + 1
+	}
+	for i, symbol := range leaves {
+		if depth[i] > writerMaxCodeLength {
+			return nil, errors.New("huffman code too long")
+		}
+		lengths[symbol] = depth[i]
+	}
+	return lengths, nil
+}
+
+func writeTableFile(w io.Writer, t *table, pieces []int, values [2][4][]int) error {
+	var buf []byte
+	var put = func(b ...byte) {
+		buf = append(buf, b...)
+	}
+	var put16 = func(v int) {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(v))
+	}
+	var align = func(n int) {
+		for len(buf)%n != 0 {
+			put(0)
+		}
+	}
+
+	if t.kind == wdlTable {
+		put(wdlMagic[:]...)
+	} else {
+		put(dtzMagic[:]...)
+	}
+	var flags byte
+	if t.key != t.key2 {
+		flags |= 1
+	}
+	if t.hasPawns {
+		flags |= 2
+	}
+	put(flags)
+	var pp = t.hasPawns && t.pawnCount[1] != 0
+	for f := 0; f < t.files; f++ {
+		put(0)
+		if pp {
+			put(0x11)
+		}
+		for _, piece := range pieces {
+			put(byte(piece | piece<<4))
+		}
+	}
+	align(2)
+
+	var maps [4][4][]int
+	var encoded [2][4]*encodedData
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var flags = t.pairs[i][f].flags
+			if t.kind == dtzTable {
+				maps[f] = dtzMaps(values[i][f])
+				flags |= flagMapped
+				for _, m := range maps[f] {
+					for _, v := range m {
+						if len(m) > 0xFF || v > 0xFF {
+							flags |= flagWide
+						}
+					}
+				}
+			}
+			var d, err = encode(values[i][f], flags)
+			if err != nil {
+				return err
+			}
+			encoded[i][f] = d
+		}
+	}
+
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = encoded[i][f]
+			put(byte(d.flags))
+			if d.flags&flagSingleValue != 0 {
+				put(byte(d.value))
+				continue
+			}
+			put(writerBlockBits, writerSpanBits, 0)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(d.blocks)))
+			put(byte(d.maxLen), byte(d.minLen))
+			for _, lowest := range d.lowest {
+				put16(lowest)
+			}
+			put16(len(d.tree))
+			for _, node := range d.tree {
+				put(byte(node[0]), byte(node[0]>>8&0xF|node[1]&0xF<<4), byte(node[1]>>4))
+			}
+			if len(d.tree)&1 != 0 {
+				put(0)
+			}
+		}
+	}
+
+	if t.kind == dtzTable {
+		for f := 0; f < t.files; f++ {
+			var wide = encoded[0][f].flags&flagWide != 0
+			for _, m := range maps[f] {
+				if wide {
+					align(2)
+					put16(len(m))
+					for _, v := range m {
+						put16(v)
+					}
+				} else {
+					put(byte(len(m)))
+					for _, v := range m {
+						put(byte(v))
+					}
+				}
+			}
+		}
+		align(2)
+	}
+
+	const span = 1 << writerSpanBits
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			var d = encoded[i][f]
+			if d.flags&flagSingleValue != 0 {
+				continue
+			}
+			var size = uint64(len(values[i][f]))
+			var block, first = 0, uint64(0)
+			for k := uint64(0); k < (size+span-1)/span; k++ {
+				var idx = k*span + span/2
+				for block+1 < len(d.blocks) && idx >= first+uint64(d.blockValues[block]) {
+					first += uint64(d.blockValues[block])
+					block++
+				}
+				var offset = idx - first
+				if offset > 0xFFFF {
+					return errors.New("table too big")
+				}
+				buf = binary.LittleEndian.AppendUint32(buf, uint32(block))
+				put16(int(offset))
+			}
+		}
+	}
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			for _, count := range encoded[i][f].blockValues {
+				put16(count - 1)
+			}
+		}
+	}
+	for f := 0; f < t.files; f++ {
+		for i := 0; i < t.sides; i++ {
+			align(64)
+			for _, block := range encoded[i][f].blocks {
+				put(block...)
+			}
+		}
+	}
+	// The decoder reads a few bytes ahead.
+	put(make([]byte, 16)...)
+
+	var _, err = w.Write(buf)
+	return err
+}